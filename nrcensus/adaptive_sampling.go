@@ -0,0 +1,163 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultAdaptiveSamplingInterval is used when AdaptiveSampling.Interval is
+// not positive.  It matches the default harvest period of the
+// telemetry.Harvester.
+const defaultAdaptiveSamplingInterval = 5 * time.Second
+
+// samplingRateAttribute is the attribute set on spans kept by
+// AdaptiveSampling or by the BaseRate of TailSampling.
+const samplingRateAttribute = "sampling.rate"
+
+// adaptiveSamplingSalt is prepended to trace IDs before they are hashed so
+// that the decisions of AdaptiveSampling are independent of those made with
+// the BaseRate of TailSampling.
+const adaptiveSamplingSalt = "adaptive:"
+
+// AdaptiveSampling configures the Exporter to record a fraction of spans
+// which is adjusted every interval to record SpansPerMinute spans per minute.
+// Whether a span is kept is decided by hashing its trace ID so that either
+// all or none of the spans of a trace are kept while the fraction is
+// unchanged.  Kept spans have a "sampling.rate" attribute with the fraction
+// of spans kept, multiplied by the BaseRate of TailSampling for traces kept
+// by it, so the number of spans represented by a kept span is 1 divided by
+// the rate.
+type AdaptiveSampling struct {
+	// SpansPerMinute is the target number of spans recorded per minute.
+	SpansPerMinute float64
+	// Interval is how often the fraction of spans kept is adjusted.  By
+	// default, Interval is 5 seconds, the default harvest period.
+	Interval time.Duration
+}
+
+// validate returns the problems with the configuration.
+func (as *AdaptiveSampling) validate() []string {
+	var problems []string
+	if as.SpansPerMinute <= 0 {
+		problems = append(problems, fmt.Sprintf("adaptive sampling spans per minute %g must be positive", as.SpansPerMinute))
+	}
+	if as.Interval < 0 {
+		problems = append(problems, fmt.Sprintf("adaptive sampling interval %s must not be negative", as.Interval))
+	}
+	return problems
+}
+
+// adaptiveSampler implements AdaptiveSampling.
+type adaptiveSampler struct {
+	target   float64
+	interval time.Duration
+	// now returns the current time.  It is replaced by tests.
+	now func() time.Time
+
+	lock sync.Mutex
+	// rate is the fraction of spans currently kept.
+	rate float64
+	// intervalStart is when the current interval started.
+	intervalStart time.Time
+	// seen is the number of spans seen in the current interval.
+	seen float64
+	// average is the moving average of the number of spans seen per
+	// interval, or negative before the first interval ends.
+	average float64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newAdaptiveSampler(config AdaptiveSampling) *adaptiveSampler {
+	interval := config.Interval
+	if interval <= 0 {
+		interval = defaultAdaptiveSamplingInterval
+	}
+	as := &adaptiveSampler{
+		target:   config.SpansPerMinute,
+		interval: interval,
+		now:      time.Now,
+		rate:     1,
+		average:  -1,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	as.intervalStart = as.now()
+	return as
+}
+
+// run adjusts the rate every interval in the background until shutdown is
+// called.  The rate only changes at the end of an interval so that all spans
+// of a trace exported within an interval get the same decision.
+func (as *adaptiveSampler) run() {
+	go func() {
+		defer close(as.done)
+		ticker := time.NewTicker(as.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				as.endInterval()
+			case <-as.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops the background goroutine started by run.
+func (as *adaptiveSampler) shutdown() {
+	as.stopOnce.Do(func() {
+		close(as.stop)
+		<-as.done
+	})
+}
+
+// sample returns whether the span of the trace is kept and the fraction of
+// spans currently kept.
+func (as *adaptiveSampler) sample(traceID string) (bool, float64) {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	as.seen++
+	return traceIDRatio(adaptiveSamplingSalt+traceID) < as.rate, as.rate
+}
+
+// endInterval adjusts the rate from the spans seen in the interval which
+// just ended and starts the next interval.
+func (as *adaptiveSampler) endInterval() {
+	now := as.now()
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	if elapsed := now.Sub(as.intervalStart); elapsed > 0 {
+		as.adjust(elapsed)
+	}
+	as.intervalStart = now
+}
+
+// adjust sets the rate from the spans seen in the interval which just ended.
+// as.lock must be held.
+func (as *adaptiveSampler) adjust(elapsed time.Duration) {
+	// Scale the number of spans seen to a full interval in case the ticker
+	// was delayed.
+	seen := as.seen * float64(as.interval) / float64(elapsed)
+	as.seen = 0
+	if as.average < 0 {
+		as.average = seen
+	} else {
+		as.average = (as.average + seen) / 2
+	}
+	budget := as.target * as.interval.Minutes()
+	if as.average <= budget {
+		as.rate = 1
+		return
+	}
+	as.rate = budget / as.average
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+func TestAdaptiveSampler(t *testing.T) {
+	as := newAdaptiveSampler(AdaptiveSampling{SpansPerMinute: 100, Interval: time.Minute})
+	now := testTime
+	as.now = func() time.Time { return now }
+	as.intervalStart = now
+
+	kept := func(n int) int {
+		var k int
+		for i := 0; i < n; i++ {
+			if keep, _ := as.sample(fmt.Sprint(now, i)); keep {
+				k++
+			}
+		}
+		return k
+	}
+	// All spans are kept until the first interval ends.
+	if k := kept(1000); k != 1000 {
+		t.Errorf("%d of 1000 spans kept in the first interval", k)
+	}
+	now = now.Add(time.Minute)
+	as.endInterval()
+	if k := kept(1000); k < 70 || k > 130 {
+		t.Errorf("%d of 1000 spans kept, want about 100", k)
+	}
+	if as.rate != 0.1 {
+		t.Errorf("incorrect rate: %g", as.rate)
+	}
+	// The rate recovers gradually when the traffic drops.
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		as.endInterval()
+		kept(10)
+	}
+	now = now.Add(time.Minute)
+	as.endInterval()
+	if as.rate != 1 {
+		t.Errorf("incorrect rate after traffic dropped: %g", as.rate)
+	}
+}
+
+func TestAdaptiveSamplerTraceConsistent(t *testing.T) {
+	as := newAdaptiveSampler(AdaptiveSampling{SpansPerMinute: 1})
+	as.rate = 0.5
+	for i := 0; i < 100; i++ {
+		traceID := fmt.Sprint(i)
+		first, _ := as.sample(traceID)
+		for j := 0; j < 5; j++ {
+			if keep, _ := as.sample(traceID); keep != first {
+				t.Fatalf("inconsistent decision for trace %s", traceID)
+			}
+		}
+	}
+}
+
+func TestExporterAdaptiveSampling(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:        h,
+		ServiceName:      "serviceName",
+		AdaptiveSampling: &AdaptiveSampling{SpansPerMinute: 1},
+	}
+	exp.adaptive().rate = 0.5
+	attrs := map[string]interface{}{"key": "value"}
+	for i := 0; i < 100; i++ {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: trace.TraceID{byte(i)},
+			},
+			Name:       "spanName",
+			StartTime:  testTime,
+			EndTime:    testTime.Add(time.Second),
+			Attributes: attrs,
+		})
+	}
+	if err := exp.Shutdown(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	for _, sp := range h.spans {
+		if sp.Attributes[samplingRateAttribute] != 0.5 {
+			t.Errorf("incorrect sampling rate attribute: %#v", sp.Attributes)
+		}
+	}
+	if stats := exp.Stats(); stats.SpansSampledOut+int64(len(h.spans)) != 100 || 0 == stats.SpansSampledOut || 0 == len(h.spans) {
+		t.Errorf("incorrect stats: %#v, %d spans recorded", stats, len(h.spans))
+	}
+}
+
+func TestExporterAdaptiveAndTailSampling(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:        h,
+		ServiceName:      "serviceName",
+		TailSampling:     &TailSampling{Window: time.Hour, BaseRate: 0.5, MinDuration: time.Minute},
+		AdaptiveSampling: &AdaptiveSampling{SpansPerMinute: 1},
+	}
+	// The rates differ so that correlated decisions would keep fewer traces
+	// than the product of the rates.
+	exp.adaptive().rate = 0.8
+	const traces = 4000
+	for i := 0; i < traces; i++ {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: trace.TraceID{byte(i), byte(i >> 8)},
+			},
+			Name:      "spanName",
+			StartTime: testTime,
+			EndTime:   testTime.Add(time.Second),
+		})
+	}
+	// A trace which matches a policy is only sampled by AdaptiveSampling.
+	var slow []float64
+	for i := 0; i < 100; i++ {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: trace.TraceID{byte(i), byte(i >> 8), 1},
+			},
+			Name:      "slow",
+			StartTime: testTime,
+			EndTime:   testTime.Add(time.Hour),
+		})
+	}
+	if err := exp.Shutdown(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+
+	// Re-weighting the kept spans estimates the number of spans exported.
+	var estimate float64
+	for _, sp := range h.spans {
+		rate := sp.Attributes[samplingRateAttribute].(float64)
+		if "slow" == sp.Name {
+			slow = append(slow, rate)
+			continue
+		}
+		if rate != 0.4 {
+			t.Fatalf("incorrect sampling rate: %g", rate)
+		}
+		estimate += 1 / rate
+	}
+	if estimate < 0.9*traces || estimate > 1.1*traces {
+		t.Errorf("re-weighted estimate %g, want about %d", estimate, traces)
+	}
+	for _, rate := range slow {
+		if rate != 0.8 {
+			t.Fatalf("incorrect sampling rate of policy trace: %g", rate)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+// addCommonAttributes adds the common attributes to attrs.  Common attributes
+// take precedence over resource attributes, so they must be added first, but
+// do not overwrite attributes already in attrs.
+func addCommonAttributes(attrs map[string]interface{}, common map[string]interface{}) {
+	for k, v := range common {
+		if _, in := attrs[k]; !in {
+			attrs[k] = v
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const (
+	// overflowTagValue replaces the value of every tag of the rows of a view
+	// which exceed Exporter.ViewCardinalityLimit.
+	overflowTagValue = "other"
+	// cardinalityOverflowMetricName is the name of the Gauge metric recorded
+	// when rows of a view exceed Exporter.ViewCardinalityLimit.
+	cardinalityOverflowMetricName = "nrcensus.view.cardinality.overflow"
+)
+
+// cardinalityLimiter tracks the distinct tag sets of each view and when they
+// were last seen.  Tag sets are forgotten once they have not been seen for
+// the expiration age, in the same manner as the cumulative values of
+// distributionCalculator.  The zero value is ready to use with the default
+// expiration settings.
+type cardinalityLimiter struct {
+	lock      sync.Mutex
+	seen      map[string]map[string]time.Time
+	lastClean time.Time
+	// expirationAge and expirationCheckInterval use the defaults when zero.
+	expirationAge           time.Duration
+	expirationCheckInterval time.Duration
+}
+
+// admit returns true if the tag set may be exported for the view at time
+// now, which is the case if it has been seen before or fewer than limit tag
+// sets have been seen for the view.
+func (cl *cardinalityLimiter) admit(viewName, tags string, limit int, now time.Time) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if nil == cl.seen {
+		cl.seen = make(map[string]map[string]time.Time)
+	}
+	expirationAge := cl.expirationAge
+	if 0 == expirationAge {
+		expirationAge = defaultDeltaExpirationAge
+	}
+	expirationCheckInterval := cl.expirationCheckInterval
+	if 0 == expirationCheckInterval {
+		expirationCheckInterval = defaultDeltaExpirationCheckInterval
+	}
+	if now.Sub(cl.lastClean) > expirationCheckInterval {
+		cutoff := now.Add(-expirationAge)
+		for name, seen := range cl.seen {
+			for k, when := range seen {
+				if when.Before(cutoff) {
+					delete(seen, k)
+				}
+			}
+			if 0 == len(seen) {
+				delete(cl.seen, name)
+			}
+		}
+		cl.lastClean = now
+	}
+
+	seen, ok := cl.seen[viewName]
+	if !ok {
+		seen = make(map[string]time.Time)
+		cl.seen[viewName] = seen
+	}
+	if when, ok := seen[tags]; ok {
+		if now.After(when) {
+			seen[tags] = now
+		}
+		return true
+	}
+	if len(seen) >= limit {
+		return false
+	}
+	seen[tags] = now
+	return true
+}
+
+// tagSetKey returns a string identifying the tag set.
+func tagSetKey(tags []tag.Tag) string {
+	var b strings.Builder
+	for _, t := range tags {
+		b.WriteString(t.Key.Name())
+		b.WriteByte(0)
+		b.WriteString(t.Value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// limitCardinality returns the rows of vd with the rows whose tag sets exceed
+// the ViewCardinalityLimit merged into a single row, whose tags all have the
+// value "other".  The number of rows merged is also returned.
+func (e *Exporter) limitCardinality(vd *view.Data) ([]*view.Row, int) {
+	if e.ViewCardinalityLimit <= 0 {
+		return vd.Rows, 0
+	}
+	var rows []*view.Row
+	var overflow *view.Row
+	var merged int
+	for _, row := range vd.Rows {
+		if e.cardinality.admit(vd.View.Name, tagSetKey(row.Tags), e.ViewCardinalityLimit, vd.End) {
+			rows = append(rows, row)
+			continue
+		}
+		merged++
+		if nil == overflow {
+			overflow = &view.Row{Tags: overflowTags(vd.View.TagKeys)}
+			overflow.Data = copyAggregationData(row.Data)
+			continue
+		}
+		overflow.Data = mergeAggregationData(overflow.Data, row.Data)
+	}
+	if nil != overflow {
+		rows = append(rows, overflow)
+	}
+	return rows, merged
+}
+
+func overflowTags(keys []tag.Key) []tag.Tag {
+	tags := make([]tag.Tag, len(keys))
+	for i, k := range keys {
+		tags[i] = tag.Tag{Key: k, Value: overflowTagValue}
+	}
+	return tags
+}
+
+// copyAggregationData returns a copy of data which can be modified by
+// mergeAggregationData without changing the data owned by OpenCensus.
+func copyAggregationData(data view.AggregationData) view.AggregationData {
+	if d, ok := data.(*view.DistributionData); ok {
+		return &view.DistributionData{
+			Count:           d.Count,
+			Min:             d.Min,
+			Max:             d.Max,
+			Mean:            d.Mean,
+			SumOfSquaredDev: d.SumOfSquaredDev,
+			CountPerBucket:  append([]int64(nil), d.CountPerBucket...),
+		}
+	}
+	return data
+}
+
+// mergeAggregationData returns the aggregation of the values of a and b.  a
+// must have been created by copyAggregationData.  Last values cannot be
+// merged, so the value of b is used.
+func mergeAggregationData(a, b view.AggregationData) view.AggregationData {
+	switch x := a.(type) {
+	case *view.CountData:
+		if y, ok := b.(*view.CountData); ok {
+			return &view.CountData{Value: x.Value + y.Value}
+		}
+	case *view.SumData:
+		if y, ok := b.(*view.SumData); ok {
+			return &view.SumData{Value: x.Value + y.Value}
+		}
+	case *view.LastValueData:
+		return b
+	case *view.DistributionData:
+		if y, ok := b.(*view.DistributionData); ok {
+			mergeDistributionData(x, y)
+			return x
+		}
+	}
+	return a
+}
+
+// mergeDistributionData adds the values of y to x.
+func mergeDistributionData(x, y *view.DistributionData) {
+	if 0 == y.Count {
+		return
+	}
+	if 0 == x.Count {
+		x.Min, x.Max = y.Min, y.Max
+	} else {
+		if y.Min < x.Min {
+			x.Min = y.Min
+		}
+		if y.Max > x.Max {
+			x.Max = y.Max
+		}
+	}
+	count := x.Count + y.Count
+	delta := y.Mean - x.Mean
+	x.SumOfSquaredDev += y.SumOfSquaredDev + delta*delta*float64(x.Count)*float64(y.Count)/float64(count)
+	x.Mean = (x.Sum() + y.Sum()) / float64(count)
+	x.Count = count
+	if len(x.CountPerBucket) == len(y.CountPerBucket) {
+		for i, c := range y.CountPerBucket {
+			x.CountPerBucket[i] += c
+		}
+	}
+}
+
+// recordCardinalityOverflow records a Gauge metric with the number of rows of
+// the view which were merged because they exceeded the ViewCardinalityLimit.
+func (e *Exporter) recordCardinalityOverflow(vd *view.Data, merged int) {
+	attrs := map[string]interface{}{
+		"view.name":                vd.View.Name,
+		"instrumentation.provider": instrumentationProvider,
+		"collector.name":           collectorName,
+		"service.name":             e.ServiceName,
+	}
+	addCommonAttributes(attrs, e.CommonAttributes)
+	addResourceAttributes(attrs, e.Resource)
+	e.recordMetric(telemetry.Gauge{
+		Name:       cardinalityOverflowMetricName,
+		Attributes: attrs,
+		Value:      float64(merged),
+		Timestamp:  vd.End,
+	})
+}
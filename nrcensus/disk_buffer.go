@@ -0,0 +1,499 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// Defaults used when the DiskBuffer fields are zero.
+const (
+	defaultDiskBufferMaxBytes      = 100 << 20
+	defaultDiskBufferMaxAge        = 24 * time.Hour
+	defaultDiskBufferReplayTimeout = 15 * time.Second
+)
+
+const (
+	// diskBufferPruneInterval is how often the batches exceeding the
+	// DiskBuffer limits are removed.
+	diskBufferPruneInterval = time.Minute
+	// defaultHarvestTimeout matches the default HarvestTimeout of the
+	// telemetry.Harvester.
+	defaultHarvestTimeout = 15 * time.Second
+)
+
+// diskBufferFileSuffix is the suffix of the files written by the disk buffer.
+const diskBufferFileSuffix = ".nrbatch"
+
+// DiskBuffer configures the Exporter to write every batch of spans and
+// metrics to a directory before it is sent to New Relic, so that batches
+// which could not be sent, eg. during a network outage, are not lost.  Such
+// batches are sent again after a later batch is sent successfully, and when
+// an Exporter using the same directory is created, so they survive process
+// restarts.  The API key is not written to disk; batches are sent again with
+// the API key of the Exporter.
+type DiskBuffer struct {
+	// Dir is the directory the batches are written to.  It is created if
+	// it does not exist.  Each Exporter must use its own directory.
+	Dir string
+	// MaxBytes is the maximum size of the batches in the directory.  The
+	// oldest batches are removed before a batch is written to stay below
+	// it, and batches larger than MaxBytes are not written.  By default,
+	// MaxBytes is 100 MiB.
+	MaxBytes int64
+	// MaxAge is how long a batch is kept before it is removed.  By default,
+	// MaxAge is 24 hours.
+	MaxAge time.Duration
+}
+
+// validate returns the problems with the configuration.
+func (db *DiskBuffer) validate() []string {
+	var problems []string
+	if "" == db.Dir {
+		problems = append(problems, "disk buffer directory is not set")
+	}
+	if db.MaxBytes < 0 {
+		problems = append(problems, fmt.Sprintf("disk buffer max bytes %d must not be negative", db.MaxBytes))
+	}
+	if db.MaxAge < 0 {
+		problems = append(problems, fmt.Sprintf("disk buffer max age %s must not be negative", db.MaxAge))
+	}
+	return problems
+}
+
+// bufferedBatch is the format of the files written by the disk buffer.
+type bufferedBatch struct {
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// secretHeaders are not written to disk.
+var secretHeaders = []string{"Api-Key", "X-Insert-Key", "X-License-Key"}
+
+// diskBuffer is an http.RoundTripper which writes each request to disk before
+// sending it with the next RoundTripper and removes it once it is sent.
+type diskBuffer struct {
+	config DiskBuffer
+	next   http.RoundTripper
+	apiKey string
+	// harvestTimeout is how long the telemetry.Harvester retries a batch.
+	harvestTimeout time.Duration
+	// onError is called with the errors reading and writing the directory.
+	onError func(error)
+	// now returns the current time.  It is replaced by tests.
+	now func() time.Time
+
+	// pruneLock serializes writing and removing batches so that size is
+	// accurate.
+	pruneLock sync.Mutex
+	// size is at least the size of the batches in the directory.  It is
+	// recalculated by prune.
+	size int64
+
+	lock sync.Mutex
+	// inFlight holds the names of the files being sent.
+	inFlight map[string]bool
+	// retrying holds the names of the files which the telemetry.Harvester
+	// may still retry, and when it stops retrying them.  They are not
+	// replayed until then so that they are not sent twice.
+	retrying map[string]time.Time
+
+	replay   chan struct{}
+	stopOnce sync.Once
+	stop     chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newDiskBuffer(config DiskBuffer, onError func(error)) (*diskBuffer, error) {
+	if 0 == config.MaxBytes {
+		config.MaxBytes = defaultDiskBufferMaxBytes
+	}
+	if 0 == config.MaxAge {
+		config.MaxAge = defaultDiskBufferMaxAge
+	}
+	if err := os.MkdirAll(config.Dir, 0700); nil != err {
+		return nil, err
+	}
+	db := &diskBuffer{
+		config:         config,
+		next:           http.DefaultTransport,
+		harvestTimeout: defaultHarvestTimeout,
+		onError:        onError,
+		now:            time.Now,
+		inFlight:       make(map[string]bool),
+		retrying:       make(map[string]time.Time),
+		replay:         make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	// Calculate the size of the batches already in the directory.
+	db.prune()
+	return db, nil
+}
+
+// configTransport returns a telemetry option which sends data through the
+// disk buffer.  It must be applied after all other options so that the
+// client and API key they configure are used.
+func (db *diskBuffer) configTransport() func(*telemetry.Config) {
+	return func(cfg *telemetry.Config) {
+		db.apiKey = cfg.APIKey
+		if cfg.HarvestTimeout > 0 {
+			db.harvestTimeout = cfg.HarvestTimeout
+		}
+		client := &http.Client{}
+		if nil != cfg.Client {
+			*client = *cfg.Client
+		}
+		if nil != client.Transport {
+			db.next = client.Transport
+		}
+		client.Transport = db
+		cfg.Client = client
+	}
+}
+
+func (db *diskBuffer) handleError(err error) {
+	if nil != db.onError {
+		db.onError(err)
+	}
+}
+
+// start sends the batches already in the directory, and those which later
+// fail to send, and removes the batches exceeding the limits in the
+// background until shutdown is called.
+func (db *diskBuffer) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	db.cancel = cancel
+	db.signalReplay()
+	go func() {
+		defer close(db.done)
+		ticker := time.NewTicker(diskBufferPruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.replay:
+				db.replayAll(ctx)
+			case <-ticker.C:
+				db.prune()
+			case <-db.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops sending batches in the background.  The batches which were
+// not sent remain in the directory.
+func (db *diskBuffer) shutdown() {
+	db.stopOnce.Do(func() {
+		close(db.stop)
+		if nil != db.cancel {
+			db.cancel()
+			<-db.done
+		}
+	})
+}
+
+func (db *diskBuffer) signalReplay() {
+	select {
+	case db.replay <- struct{}{}:
+	default:
+	}
+}
+
+// batchName returns the name of the file for the batch, which is derived from
+// its contents so that retries of the same request use the same file.
+func batchName(b *bufferedBatch) string {
+	h := sha256.New()
+	h.Write([]byte(b.URL))
+	h.Write([]byte{0})
+	h.Write(b.Body)
+	return hex.EncodeToString(h.Sum(nil)) + diskBufferFileSuffix
+}
+
+// sent returns true if the response means the batch must not be sent again,
+// either because it was accepted or because New Relic will never accept it.
+func sent(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case 200, 202, 400, 403, 404, 405, 411, 413:
+		return true
+	default:
+		return false
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (db *diskBuffer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := requestBody(req)
+	if nil != err {
+		return nil, err
+	}
+	batch := &bufferedBatch{URL: req.URL.String(), Header: req.Header.Clone(), Body: body}
+	for _, h := range secretHeaders {
+		batch.Header.Del(h)
+	}
+	name := batchName(batch)
+	if err := db.write(name, batch); nil != err {
+		db.handleError(err)
+	}
+	db.lock.Lock()
+	if _, ok := db.retrying[name]; !ok {
+		db.retrying[name] = db.now().Add(db.harvestTimeout)
+	}
+	db.lock.Unlock()
+
+	out := req.Clone(req.Context())
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	resp, err := db.send(name, out)
+	if nil == err && (resp.StatusCode == 200 || resp.StatusCode == 202) {
+		db.signalReplay()
+	}
+	return resp, err
+}
+
+// requestBody reads the body of the request.  The telemetry.Harvester reuses
+// the request when it retries, so the body is read with GetBody when possible
+// to read the whole body on every attempt.
+func requestBody(req *http.Request) ([]byte, error) {
+	if nil != req.Body {
+		defer req.Body.Close()
+	}
+	if nil != req.GetBody {
+		rc, err := req.GetBody()
+		if nil != err {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	if nil == req.Body {
+		return nil, nil
+	}
+	return ioutil.ReadAll(req.Body)
+}
+
+// send sends the request for the batch in the named file, removing the file
+// once it does not need to be sent again.
+func (db *diskBuffer) send(name string, req *http.Request) (*http.Response, error) {
+	db.lock.Lock()
+	db.inFlight[name] = true
+	db.lock.Unlock()
+	defer func() {
+		db.lock.Lock()
+		delete(db.inFlight, name)
+		db.lock.Unlock()
+	}()
+
+	resp, err := db.next.RoundTrip(req)
+	if nil == err && sent(resp) {
+		db.lock.Lock()
+		delete(db.retrying, name)
+		db.lock.Unlock()
+		if err := os.Remove(filepath.Join(db.config.Dir, name)); nil != err && !os.IsNotExist(err) {
+			db.handleError(err)
+		}
+	}
+	return resp, err
+}
+
+// write writes the batch to the named file unless it already exists.  The
+// oldest batches are removed first if the batch would take the directory over
+// MaxBytes.
+func (db *diskBuffer) write(name string, batch *bufferedBatch) error {
+	path := filepath.Join(db.config.Dir, name)
+	if _, err := os.Stat(path); nil == err {
+		return nil
+	}
+	data, err := json.Marshal(batch)
+	if nil != err {
+		return err
+	}
+	size := int64(len(data))
+	if size > db.config.MaxBytes {
+		return fmt.Errorf("disk buffer batch of %d bytes exceeds the limit of %d bytes", size, db.config.MaxBytes)
+	}
+	db.pruneLock.Lock()
+	defer db.pruneLock.Unlock()
+	if db.size+size > db.config.MaxBytes {
+		db.pruneLocked(size)
+	}
+	// Write to a temporary file first so that a partially written batch is
+	// never read.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); nil != err {
+		return err
+	}
+	if err := os.Rename(tmp, path); nil != err {
+		return err
+	}
+	db.size += size
+	return nil
+}
+
+// batchFile describes a file in the directory.
+type batchFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// files returns the batch files in the directory, oldest first.
+func (db *diskBuffer) files() ([]batchFile, error) {
+	infos, err := ioutil.ReadDir(db.config.Dir)
+	if nil != err {
+		return nil, err
+	}
+	var files []batchFile
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), diskBufferFileSuffix) {
+			continue
+		}
+		files = append(files, batchFile{name: info.Name(), size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].modTime.Equal(files[j].modTime) {
+			return files[i].name < files[j].name
+		}
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files, nil
+}
+
+// prune removes the batches which are older than MaxAge and the oldest
+// batches while the directory is larger than MaxBytes, and forgets the
+// batches which the telemetry.Harvester no longer retries.  It returns the
+// remaining files, oldest first.
+func (db *diskBuffer) prune() []batchFile {
+	db.pruneLock.Lock()
+	defer db.pruneLock.Unlock()
+	return db.pruneLocked(0)
+}
+
+// pruneLocked implements prune, leaving room for reserve more bytes.
+// db.pruneLock must be held.
+func (db *diskBuffer) pruneLocked(reserve int64) []batchFile {
+	now := db.now()
+	db.lock.Lock()
+	for name, until := range db.retrying {
+		if !now.Before(until) {
+			delete(db.retrying, name)
+		}
+	}
+	db.lock.Unlock()
+
+	files, err := db.files()
+	if nil != err {
+		db.handleError(err)
+		return nil
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	cutoff := now.Add(-db.config.MaxAge)
+	kept := files[:0]
+	for _, f := range files {
+		if f.modTime.Before(cutoff) || total+reserve > db.config.MaxBytes {
+			if err := os.Remove(filepath.Join(db.config.Dir, f.name)); nil != err && !os.IsNotExist(err) {
+				db.handleError(err)
+			}
+			total -= f.size
+			continue
+		}
+		kept = append(kept, f)
+	}
+	db.size = total
+	return kept
+}
+
+// replayAll sends the batches in the directory, oldest first, stopping at the
+// first batch which fails to send.  Batches which are being sent or which the
+// telemetry.Harvester may still retry are skipped.
+func (db *diskBuffer) replayAll(ctx context.Context) {
+	for _, f := range db.prune() {
+		if nil != ctx.Err() {
+			return
+		}
+		if db.inUse(f.name) {
+			continue
+		}
+		if !db.replayFile(ctx, f.name) {
+			return
+		}
+	}
+}
+
+// inUse returns true if the named file is being sent or may still be retried
+// by the telemetry.Harvester.
+func (db *diskBuffer) inUse(name string) bool {
+	now := db.now()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.inFlight[name] {
+		return true
+	}
+	until, ok := db.retrying[name]
+	return ok && now.Before(until)
+}
+
+// replayFile sends the batch in the named file, returning false if it could
+// not be sent.
+func (db *diskBuffer) replayFile(ctx context.Context, name string) bool {
+	path := filepath.Join(db.config.Dir, name)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if nil != err {
+		db.handleError(err)
+		return false
+	}
+	var batch bufferedBatch
+	if err := json.Unmarshal(data, &batch); nil != err {
+		// The file is corrupt and will never be sent.
+		db.handleError(fmt.Errorf("removing unreadable disk buffer batch %s: %v", name, err))
+		os.Remove(path)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDiskBufferReplayTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", batch.URL, bytes.NewReader(batch.Body))
+	if nil != err {
+		db.handleError(fmt.Errorf("removing invalid disk buffer batch %s: %v", name, err))
+		os.Remove(path)
+		return true
+	}
+	req = req.WithContext(ctx)
+	for k, v := range batch.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Api-Key", db.apiKey)
+	resp, err := db.send(name, req)
+	if nil != err {
+		return false
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return sent(resp)
+}
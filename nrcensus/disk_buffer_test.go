@@ -0,0 +1,283 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/trace"
+)
+
+// outageServer fails requests while down and records the API keys of the
+// requests it accepts.
+type outageServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	down     bool
+	accepted []string
+}
+
+func newOutageServer() *outageServer {
+	s := &outageServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.accepted = append(s.accepted, r.Header.Get("Api-Key"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return s
+}
+
+func (s *outageServer) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+func (s *outageServer) acceptedKeys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.accepted...)
+}
+
+func batchFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+diskBufferFileSuffix))
+	if nil != err {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestDiskBufferOutage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nrcensus")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newOutageServer()
+	defer srv.Close()
+
+	newExporter := func() *Exporter {
+		exp, err := NewExporterWithOptions("serviceName", "apiKey",
+			ConfigDiskBuffer(DiskBuffer{Dir: dir}),
+			ConfigTelemetry(
+				telemetry.ConfigHarvestPeriod(0),
+				telemetry.ConfigSpansURLOverride(srv.URL),
+				func(cfg *telemetry.Config) { cfg.HarvestTimeout = 100 * time.Millisecond },
+			),
+		)
+		if nil != err {
+			t.Fatal(err)
+		}
+		return exp
+	}
+
+	srv.setDown(true)
+	exp := newExporter()
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{SpanID: testSpanID, TraceID: testTraceID},
+		Name:        "spanName",
+		StartTime:   testTime,
+		EndTime:     testTime.Add(time.Second),
+	})
+	exp.Shutdown(context.Background())
+
+	files := batchFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("incorrect number of buffered batches: %v", files)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if nil != err {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "apiKey") {
+		t.Error("API key written to disk")
+	}
+
+	// The batch is sent by a new Exporter once the server is up again.
+	srv.setDown(false)
+	exp = newExporter()
+	defer exp.Shutdown(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for len(batchFiles(t, dir)) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files := batchFiles(t, dir); len(files) != 0 {
+		t.Errorf("batches not sent: %v", files)
+	}
+	if keys := srv.acceptedKeys(); len(keys) != 1 || keys[0] != "apiKey" {
+		t.Errorf("incorrect requests accepted: %v", keys)
+	}
+}
+
+func TestDiskBufferPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nrcensus")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := newDiskBuffer(DiskBuffer{Dir: dir, MaxBytes: 250, MaxAge: time.Hour}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	db.now = func() time.Time { return now }
+	write := func(name string, age time.Duration) {
+		path := filepath.Join(dir, name+diskBufferFileSuffix)
+		if err := ioutil.WriteFile(path, make([]byte, 100), 0600); nil != err {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); nil != err {
+			t.Fatal(err)
+		}
+	}
+	write("expired", 2*time.Hour)
+	write("oldest", 3*time.Minute)
+	write("older", 2*time.Minute)
+	write("newest", time.Minute)
+
+	var names []string
+	for _, f := range db.prune() {
+		names = append(names, strings.TrimSuffix(f.name, diskBufferFileSuffix))
+	}
+	if strings.Join(names, ",") != "older,newest" {
+		t.Errorf("incorrect batches kept: %v", names)
+	}
+	if files := batchFiles(t, dir); len(files) != 2 {
+		t.Errorf("batches not removed: %v", files)
+	}
+}
+
+func TestDiskBufferMaxBytesOnWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nrcensus")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	batch := &bufferedBatch{URL: "https://example.com", Body: []byte("batch")}
+	data, err := json.Marshal(batch)
+	if nil != err {
+		t.Fatal(err)
+	}
+	size := int64(len(data))
+	db, err := newDiskBuffer(DiskBuffer{Dir: dir, MaxBytes: 3 * size}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("batch%d%s", i, diskBufferFileSuffix)
+		if err := db.write(name, batch); nil != err {
+			t.Fatal(err)
+		}
+		// Give each batch a distinct age so that the oldest is removed.
+		modTime := now.Add(time.Duration(i-5) * time.Minute)
+		if err := os.Chtimes(filepath.Join(dir, name), modTime, modTime); nil != err {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, f := range batchFiles(t, dir) {
+			info, err := os.Stat(f)
+			if nil != err {
+				t.Fatal(err)
+			}
+			total += info.Size()
+		}
+		if total > 3*size {
+			t.Errorf("directory size %d exceeds max bytes %d after %d writes", total, 3*size, i+1)
+		}
+	}
+	var names []string
+	for _, f := range batchFiles(t, dir) {
+		names = append(names, strings.TrimSuffix(filepath.Base(f), diskBufferFileSuffix))
+	}
+	if strings.Join(names, ",") != "batch2,batch3,batch4" {
+		t.Errorf("incorrect batches kept: %v", names)
+	}
+
+	large := &bufferedBatch{URL: "https://example.com", Body: make([]byte, 3*size)}
+	if err := db.write("large"+diskBufferFileSuffix, large); nil == err {
+		t.Error("batch larger than max bytes written")
+	}
+	if files := batchFiles(t, dir); len(files) != 3 {
+		t.Errorf("batches removed for a batch larger than max bytes: %v", files)
+	}
+}
+
+// roundTripperFunc implements http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDiskBufferSkipsRetryingBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nrcensus")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := newDiskBuffer(DiskBuffer{Dir: dir}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	db.now = func() time.Time { return now }
+	var requests int
+	db.next = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+
+	req, err := http.NewRequest("POST", "https://example.com", strings.NewReader("batch"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := db.RoundTrip(req); nil != err {
+		t.Fatal(err)
+	}
+	// The batch is not replayed while the Harvester may retry it.
+	db.replayAll(context.Background())
+	if requests != 1 {
+		t.Errorf("batch replayed while the Harvester may retry it: %d requests", requests)
+	}
+	now = now.Add(db.harvestTimeout)
+	db.replayAll(context.Background())
+	if requests != 2 {
+		t.Errorf("batch not replayed after the harvest timeout: %d requests", requests)
+	}
+	if len(db.retrying) != 0 {
+		t.Errorf("retrying batches not forgotten: %v", db.retrying)
+	}
+}
+
+func TestNewExporterInvalidDiskBuffer(t *testing.T) {
+	_, err := NewExporterWithOptions("serviceName", "apiKey",
+		ConfigDiskBuffer(DiskBuffer{MaxBytes: -1}),
+		ConfigTelemetry(telemetry.ConfigHarvestPeriod(0)),
+	)
+	want := "invalid exporter config: disk buffer directory is not set; disk buffer max bytes -1 must not be negative"
+	if err == nil || err.Error() != want {
+		t.Errorf("incorrect error:\ngot  %v\nwant %s", err, want)
+	}
+}
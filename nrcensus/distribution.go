@@ -0,0 +1,281 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats/view"
+)
+
+// distribution is a snapshot of an OpenCensus distribution aggregation.
+// bounds holds the bucket boundaries and buckets holds the number of values
+// in each bucket, with len(buckets) == len(bounds)+1 when bucket data is
+// available.  Bucket i contains the values v where bounds[i-1] <= v <
+// bounds[i].
+type distribution struct {
+	count   int64
+	sum     float64
+	min     float64
+	max     float64
+	bounds  []float64
+	buckets []int64
+}
+
+func distributionFromView(bounds []float64, data *view.DistributionData) distribution {
+	return distribution{
+		count:   data.Count,
+		sum:     data.Sum(),
+		min:     data.Min,
+		max:     data.Max,
+		bounds:  bounds,
+		buckets: data.CountPerBucket,
+	}
+}
+
+// distributionFromMetricdata creates a distribution from a metricdata
+// distribution.  metricdata does not report the min and max of the values so
+// the min is estimated as the lower edge of the lowest non-empty bucket and
+// the max as the upper edge of the highest non-empty bucket.
+func distributionFromMetricdata(data *metricdata.Distribution) distribution {
+	d := distribution{
+		count: data.Count,
+		sum:   data.Sum,
+	}
+	if nil != data.BucketOptions {
+		d.bounds = data.BucketOptions.Bounds
+	}
+	if len(data.Buckets) > 0 {
+		d.buckets = make([]int64, len(data.Buckets))
+		for i, b := range data.Buckets {
+			d.buckets[i] = b.Count
+		}
+	}
+	var mean float64
+	if data.Count > 0 {
+		mean = data.Sum / float64(data.Count)
+	}
+	d.min, d.max = mean, mean
+	if !d.hasBuckets() {
+		return d
+	}
+	for i, c := range d.buckets {
+		if c > 0 {
+			d.min, _ = d.bucketEdges(i, mean)
+			break
+		}
+	}
+	for i := len(d.buckets) - 1; i >= 0; i-- {
+		if d.buckets[i] > 0 {
+			_, d.max = d.bucketEdges(i, mean)
+			break
+		}
+	}
+	return d
+}
+
+// bucketEdges returns the lower and upper edge of bucket i.  The lower edge
+// of the first bucket and the upper edge of the last bucket are unbounded and
+// are estimated by the mean, limited to the bucket's other edge.
+func (d distribution) bucketEdges(i int, mean float64) (float64, float64) {
+	lower, upper := mean, mean
+	if i > 0 {
+		lower = d.bounds[i-1]
+	}
+	if i < len(d.bounds) {
+		upper = d.bounds[i]
+	}
+	if 0 == i {
+		lower = math.Min(lower, upper)
+	}
+	if len(d.bounds) == i {
+		upper = math.Max(upper, lower)
+	}
+	return lower, upper
+}
+
+// hasBuckets returns true if the bucket counts line up with the bounds.
+func (d distribution) hasBuckets() bool {
+	return len(d.buckets) > 0 && len(d.buckets) == len(d.bounds)+1
+}
+
+// bucketRange returns the lower and upper boundary of bucket i.  The first
+// and last buckets are unbounded and are clamped to the min and max of the
+// distribution.
+func (d distribution) bucketRange(i int) (float64, float64) {
+	lower, upper := d.min, d.max
+	if i > 0 {
+		lower = math.Max(lower, d.bounds[i-1])
+	}
+	if i < len(d.bounds) {
+		upper = math.Min(upper, d.bounds[i])
+	}
+	return lower, upper
+}
+
+// sub returns the distribution of the values added between the previous
+// cumulative snapshot and d.  OpenCensus only reports the cumulative min and
+// max, so when they did not change over the interval they are estimated from
+// the boundaries of the lowest and highest non-empty buckets.
+func (d distribution) sub(previous distribution) distribution {
+	delta := distribution{
+		count:  d.count - previous.count,
+		sum:    d.sum - previous.sum,
+		min:    d.min,
+		max:    d.max,
+		bounds: d.bounds,
+	}
+	if d.hasBuckets() && len(previous.buckets) == len(d.buckets) {
+		delta.buckets = make([]int64, len(d.buckets))
+		for i := range d.buckets {
+			delta.buckets[i] = d.buckets[i] - previous.buckets[i]
+		}
+	}
+	if nil == delta.buckets {
+		return delta
+	}
+	if d.min >= previous.min {
+		for i, c := range delta.buckets {
+			if c > 0 {
+				delta.min, _ = d.bucketRange(i)
+				break
+			}
+		}
+	}
+	if d.max <= previous.max {
+		for i := len(delta.buckets) - 1; i >= 0; i-- {
+			if delta.buckets[i] > 0 {
+				_, delta.max = d.bucketRange(i)
+				break
+			}
+		}
+	}
+	return delta
+}
+
+// percentile estimates the value below which p percent of the values in the
+// distribution fall by linearly interpolating within the bucket containing
+// that rank.
+func (d distribution) percentile(p float64) float64 {
+	rank := p / 100 * float64(d.count)
+	var seen float64
+	for i, c := range d.buckets {
+		if c <= 0 {
+			continue
+		}
+		count := float64(c)
+		if seen+count >= rank {
+			lower, upper := d.bucketRange(i)
+			return lower + (upper-lower)*(rank-seen)/count
+		}
+		seen += count
+	}
+	return d.max
+}
+
+// percentileMetricName returns the name of the Gauge metric for percentile p
+// of the named view, eg. "latency.p99" or "latency.p99.9".
+func percentileMetricName(name string, p float64) string {
+	return name + ".p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// bucketsMetricSuffix is appended to the view name to create the name of the
+// bucket Count metrics.
+const bucketsMetricSuffix = ".buckets"
+
+// bucketBoundary returns the upper boundary of bucket i formatted for the
+// "le" attribute.
+func bucketBoundary(bounds []float64, i int) string {
+	if i >= len(bounds) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bounds[i], 'g', -1, 64)
+}
+
+type distributionIdentity struct {
+	name           string
+	attributesJSON string
+}
+
+type lastDistribution struct {
+	when  time.Time
+	value distribution
+}
+
+const (
+	// These match the defaults of cumulative.DeltaCalculator.
+	defaultDeltaExpirationAge           = 20 * time.Minute
+	defaultDeltaExpirationCheckInterval = 20 * time.Minute
+)
+
+// distributionCalculator creates delta distributions from the cumulative
+// distributions reported by OpenCensus in the same manner that
+// cumulative.DeltaCalculator creates Count metrics from cumulative values.
+// The zero value is ready to use with the default expiration settings.
+type distributionCalculator struct {
+	lock       sync.Mutex
+	datapoints map[distributionIdentity]lastDistribution
+	lastClean  time.Time
+	// expirationAge and expirationCheckInterval use the defaults when zero.
+	expirationAge           time.Duration
+	expirationCheckInterval time.Duration
+}
+
+// delta returns the difference between d and the previous distribution seen
+// for the name/attributes combination along with the start time of the
+// difference.  If this is the first time the combination has been seen, or
+// the cumulative values were reset, then the `valid` return value will be
+// false.
+func (dc *distributionCalculator) delta(name string, attributes map[string]interface{}, d distribution, now time.Time) (delta distribution, start time.Time, valid bool) {
+	// encoding/json sorts map keys so this is a stable identity.
+	attributesJSON, _ := json.Marshal(attributes)
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if nil == dc.datapoints {
+		dc.datapoints = make(map[distributionIdentity]lastDistribution)
+	}
+	expirationAge := dc.expirationAge
+	if 0 == expirationAge {
+		expirationAge = defaultDeltaExpirationAge
+	}
+	expirationCheckInterval := dc.expirationCheckInterval
+	if 0 == expirationCheckInterval {
+		expirationCheckInterval = defaultDeltaExpirationCheckInterval
+	}
+	if now.Sub(dc.lastClean) > expirationCheckInterval {
+		cutoff := now.Add(-expirationAge)
+		for k, v := range dc.datapoints {
+			if v.when.Before(cutoff) {
+				delete(dc.datapoints, k)
+			}
+		}
+		dc.lastClean = now
+	}
+
+	id := distributionIdentity{name: name, attributesJSON: string(attributesJSON)}
+	var timestampsOrdered bool
+	last, ok := dc.datapoints[id]
+	if ok {
+		timestampsOrdered = now.After(last.when)
+		if timestampsOrdered && d.count >= last.value.count {
+			delta = d.sub(last.value)
+			start = last.when
+			valid = true
+		}
+	}
+	if !ok || timestampsOrdered {
+		// Copy the buckets since OpenCensus owns the slice.
+		stored := d
+		stored.buckets = append([]int64(nil), d.buckets...)
+		dc.datapoints[id] = lastDistribution{value: stored, when: now}
+	}
+	return
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// Environment variables read by NewExporterFromEnv.
+const (
+	// EnvAPIKey is the New Relic Insights Insert API key.  It is required.
+	EnvAPIKey = "NEW_RELIC_API_KEY"
+	// EnvServiceName is the name of this service or application.  It is
+	// required.
+	EnvServiceName = "NEW_RELIC_SERVICE_NAME"
+	// EnvRegion is the New Relic region to send data to, "US", "EU", or
+	// "FedRAMP".  If unset, the region is detected from the API key when
+	// possible.
+	EnvRegion = "NEW_RELIC_REGION"
+	// EnvSpansURL overrides the URL spans are sent to.
+	EnvSpansURL = "NEW_RELIC_SPANS_URL"
+	// EnvMetricsURL overrides the URL metrics are sent to.
+	EnvMetricsURL = "NEW_RELIC_METRICS_URL"
+	// EnvIgnoreStatusCodes is a comma separated list of the trace.Status
+	// Codes which are not errors, eg. "5,16".
+	EnvIgnoreStatusCodes = "NEW_RELIC_IGNORE_STATUS_CODES"
+	// EnvHarvestPeriod is how often data is sent to New Relic as a Go
+	// duration, eg. "5s".
+	EnvHarvestPeriod = "NEW_RELIC_HARVEST_PERIOD"
+	// EnvLogLevel enables logging to standard error: "error" logs errors,
+	// "debug" also logs debug messages, and "audit" also logs all data
+	// sent.
+	EnvLogLevel = "NEW_RELIC_LOG_LEVEL"
+)
+
+// NewExporterFromEnv creates a new Exporter configured by the environment
+// variables listed above.  The options are applied after the environment and
+// take precedence over it.  The returned error lists every missing or
+// malformed environment variable.
+func NewExporterFromEnv(options ...Option) (*Exporter, error) {
+	var problems []string
+	missing := func(name string) {
+		problems = append(problems, name+" is not set")
+	}
+	malformed := func(name, val, reason string) {
+		problems = append(problems, fmt.Sprintf("%s %q %s", name, val, reason))
+	}
+
+	apiKey := os.Getenv(EnvAPIKey)
+	if "" == apiKey {
+		missing(EnvAPIKey)
+	}
+	serviceName := os.Getenv(EnvServiceName)
+	if "" == serviceName {
+		missing(EnvServiceName)
+	}
+
+	var envOptions []Option
+	var telemetryOptions []func(*telemetry.Config)
+
+	if name := os.Getenv(EnvRegion); "" != name {
+		region, ok := parseRegion(name)
+		if !ok {
+			malformed(EnvRegion, name, `is not "US", "EU", or "FedRAMP"`)
+		}
+		envOptions = append(envOptions, ConfigRegion(region))
+	}
+	if u := os.Getenv(EnvSpansURL); "" != u {
+		if !validURL(u) {
+			malformed(EnvSpansURL, u, "is not an absolute URL")
+		}
+		telemetryOptions = append(telemetryOptions, telemetry.ConfigSpansURLOverride(u))
+	}
+	if u := os.Getenv(EnvMetricsURL); "" != u {
+		if !validURL(u) {
+			malformed(EnvMetricsURL, u, "is not an absolute URL")
+		}
+		telemetryOptions = append(telemetryOptions, func(cfg *telemetry.Config) {
+			cfg.MetricsURLOverride = u
+		})
+	}
+	if codes := os.Getenv(EnvIgnoreStatusCodes); "" != codes {
+		var ignore []int32
+		for _, c := range strings.Split(codes, ",") {
+			code, err := strconv.ParseInt(strings.TrimSpace(c), 10, 32)
+			if nil != err {
+				malformed(EnvIgnoreStatusCodes, codes, "is not a comma separated list of status codes")
+				break
+			}
+			ignore = append(ignore, int32(code))
+		}
+		envOptions = append(envOptions, ConfigIgnoreStatusCodes(ignore...))
+	}
+	if period := os.Getenv(EnvHarvestPeriod); "" != period {
+		d, err := time.ParseDuration(period)
+		if nil != err || d < 0 {
+			malformed(EnvHarvestPeriod, period, "is not a non-negative duration")
+		}
+		telemetryOptions = append(telemetryOptions, telemetry.ConfigHarvestPeriod(d))
+	}
+	switch level := os.Getenv(EnvLogLevel); strings.ToLower(level) {
+	case "":
+	case "audit":
+		telemetryOptions = append(telemetryOptions, telemetry.ConfigBasicAuditLogger(os.Stderr))
+		fallthrough
+	case "debug":
+		telemetryOptions = append(telemetryOptions, telemetry.ConfigBasicDebugLogger(os.Stderr))
+		fallthrough
+	case "error":
+		telemetryOptions = append(telemetryOptions, telemetry.ConfigBasicErrorLogger(os.Stderr))
+	default:
+		malformed(EnvLogLevel, level, `is not "error", "debug", or "audit"`)
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New("invalid environment: " + strings.Join(problems, "; "))
+	}
+
+	envOptions = append(envOptions, ConfigTelemetry(telemetryOptions...))
+	return NewExporterWithOptions(serviceName, apiKey, append(envOptions, options...)...)
+}
+
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return nil == err && u.IsAbs() && "" != u.Host
+}
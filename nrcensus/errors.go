@@ -0,0 +1,78 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"fmt"
+)
+
+// SpanError is passed to Exporter.ErrorHandler when the Harvester fails to
+// record a span.
+type SpanError struct {
+	// Err is the error returned by the Harvester.
+	Err error
+	// SpanName is the name of the span that was not recorded.
+	SpanName string
+	// TraceID is the trace ID of the span that was not recorded.
+	TraceID string
+}
+
+func (e *SpanError) Error() string {
+	return fmt.Sprintf("unable to record span %q of trace %q: %v", e.SpanName, e.TraceID, e.Err)
+}
+
+// Unwrap returns the error returned by the Harvester.
+func (e *SpanError) Unwrap() error {
+	return e.Err
+}
+
+// Stats holds counts of what the Exporter has done since it was created.
+type Stats struct {
+	// SpanErrors is the number of spans the Harvester failed to record.
+	SpanErrors int64
+	// AttributesTruncated is the number of attribute keys and values
+	// truncated to the New Relic limits of 255 and 4095 bytes respectively.
+	AttributesTruncated int64
+	// AttributesDropped is the number of attributes dropped because a span
+	// or metric had more attributes than New Relic accepts.  Exporter
+	// defined attributes are kept in preference to others, which are
+	// otherwise kept in key order.
+	AttributesDropped int64
+	// TracesKept is the number of traces kept by TailSampling.
+	TracesKept int64
+	// TracesDropped is the number of traces dropped by TailSampling.
+	TracesDropped int64
+	// SpansSampledOut is the number of spans dropped by AdaptiveSampling.
+	SpansSampledOut int64
+	// Enqueued is the number of spans, view data, and metric batches added
+	// to the Queue.
+	Enqueued int64
+	// QueueDropped is the number of spans, view data, and metric batches
+	// dropped because the Queue was full.
+	QueueDropped int64
+}
+
+// Stats returns a snapshot of the Exporter's counts.
+func (e *Exporter) Stats() Stats {
+	if nil == e {
+		return Stats{}
+	}
+	e.statsLock.Lock()
+	defer e.statsLock.Unlock()
+	return e.stats
+}
+
+// updateStats calls fn to update the Exporter's counts.
+func (e *Exporter) updateStats(fn func(*Stats)) {
+	e.statsLock.Lock()
+	defer e.statsLock.Unlock()
+	fn(&e.stats)
+}
+
+// handleError passes err to the ErrorHandler if one is set.
+func (e *Exporter) handleError(err error) {
+	if nil != e.ErrorHandler {
+		e.ErrorHandler(err)
+	}
+}
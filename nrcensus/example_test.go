@@ -1,8 +1,13 @@
 package nrcensus_test
 
 import (
+	"time"
+
 	"github.com/newrelic/newrelic-opencensus-exporter-go/nrcensus"
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricexport"
+	"go.opencensus.io/metric/metricproducer"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 )
@@ -38,3 +43,43 @@ func ExampleNewExporter() {
 
 	// create stats, traces, etc
 }
+
+func ExampleExporter_ExportMetrics() {
+	exporter, err := nrcensus.NewExporter("My-OpenCensus-App", "__YOUR_NEW_RELIC_INSIGHTS_API_KEY__")
+	if err != nil {
+		panic(err)
+	}
+
+	// Metrics such as derived gauges are added to a metric.Registry, which
+	// is read and exported by a metricexport.IntervalReader.
+	registry := metric.NewRegistry()
+	metricproducer.GlobalManager().AddProducer(registry)
+	reader, err := metricexport.NewIntervalReader(metricexport.NewReader(), exporter)
+	if err != nil {
+		panic(err)
+	}
+	if err := reader.Start(); err != nil {
+		panic(err)
+	}
+	defer reader.Stop()
+
+	// create gauges, cumulatives, etc
+}
+
+func ExampleNewExporterWithOptions() {
+	exporter, err := nrcensus.NewExporterWithOptions(
+		"My-OpenCensus-App", "__YOUR_NEW_RELIC_INSIGHTS_API_KEY__",
+		// Do not mark spans with NOT_FOUND or UNAUTHENTICATED status codes
+		// as errors.
+		nrcensus.ConfigIgnoreStatusCodes(5, 16),
+		nrcensus.ConfigDistributionPercentiles(50, 90, 99),
+		nrcensus.ConfigTelemetry(telemetry.ConfigHarvestPeriod(10*time.Second)),
+	)
+	if err != nil {
+		panic(err)
+	}
+	view.RegisterExporter(exporter)
+	trace.RegisterExporter(exporter)
+
+	// create stats, traces, etc
+}
@@ -4,8 +4,16 @@
 package nrcensus
 
 import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/resource"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 )
@@ -40,30 +48,224 @@ type Exporter struct {
 	// modify the cache cleaning interval on this DeltaCalculator in order to
 	// avoid missing metrics or spikes in graphs when your data is assimilated.
 	DeltaCalculator *cumulative.DeltaCalculator
+	// Resource describes the entity being monitored, such as the host,
+	// container, or pod.  The labels of the Resource, and its type as the
+	// "resource.type" attribute, are added to all spans and metrics unless
+	// they already have an attribute with the same name.  When instantiated
+	// with NewExporter this field is detected from the OC_RESOURCE_TYPE and
+	// OC_RESOURCE_LABELS environment variables.
+	Resource *resource.Resource
+	// ExportDistributionBuckets controls whether the buckets of distribution
+	// views are exported in addition to the summary of the distribution.
+	// When enabled, the number of values in each bucket is recorded as a
+	// delta Count metric named after the view with a ".buckets" suffix.  The
+	// upper boundary of each bucket is recorded in the "le" attribute, which
+	// is "+Inf" for the last bucket.  Counts are per bucket, not cumulative
+	// across buckets.
+	ExportDistributionBuckets bool
+	// DistributionPercentiles are the percentiles, between 0 and 100, to
+	// compute for distribution views.  Each percentile is estimated from the
+	// buckets of the values recorded since the previous export and is
+	// recorded as a Gauge metric named after the view with a ".p" and the
+	// percentile as a suffix, eg. "latency.p99".
+	DistributionPercentiles []float64
+	// ExportSpanEvents controls whether the annotations, message events, and
+	// links of spans are exported.  The New Relic Trace API does not support
+	// events within a span, so each is exported as a zero duration child
+	// span which counts towards span ingest, and annotations are named after
+	// their message.  ocgrpc records two message events for every RPC.
+	ExportSpanEvents bool
+	// CommonAttributes are added to all spans and metrics, eg. to identify
+	// the environment or version of the service.  Attributes defined by the
+	// exporter, such as "service.name", and the attributes of spans and tags
+	// of views take precedence over common attributes, which in turn take
+	// precedence over the labels of the Resource.
+	CommonAttributes map[string]interface{}
+	// AttributeFilter, if set, removes and redacts the attributes of spans,
+	// span annotations, and span links, the tags of views, and the labels of
+	// metrics before they are exported.  Rows of a view whose tags are the
+	// same once filtered, and time series of a metric whose labels are the
+	// same once filtered, are merged.
+	AttributeFilter *AttributeFilter
+	// ViewCardinalityLimit, if positive, is the maximum number of distinct
+	// tag sets exported for each view.  The rows of a view with tag sets
+	// first seen after the limit is reached are merged into a single row
+	// whose tags all have the value "other", and a Gauge metric named
+	// "nrcensus.view.cardinality.overflow" with a "view.name" attribute
+	// records the number of rows merged.  Tag sets which have not been
+	// seen for 20 minutes, or the DeltaExpirationAge when instantiated with
+	// NewExporterWithOptions, no longer count towards the limit.
+	ViewCardinalityLimit int
+	// ViewRules rename, drop, and remap the tags of views before they are
+	// exported.  The first rule which matches the name of a view is applied
+	// before AttributeFilter and ViewCardinalityLimit.
+	ViewRules []ViewRule
+	// ConvertUnits controls whether the values of sum, last value, and
+	// distribution views are converted to seconds or bytes when the unit of
+	// the view's measure is a UCUM unit of time, such as "ms", or of
+	// information, such as "kBy".  The "measure.unit" attribute is set to
+	// "s" or "By" respectively.  The unit set by a ViewRule is the unit
+	// converted from.
+	ConvertUnits bool
+	// TailSampling, if set, buffers the spans of each trace and only
+	// records the traces which its policies keep.  It must not be changed
+	// after the first span is exported.  Call Shutdown to stop the
+	// goroutine which makes the decisions.
+	TailSampling *TailSampling
+	// AdaptiveSampling, if set, records a fraction of spans which is
+	// adjusted to record a target number of spans per minute.  It is
+	// applied after TailSampling.  It must not be changed after the first
+	// span is exported.
+	AdaptiveSampling *AdaptiveSampling
+	// ExportSpanMetrics controls whether request rate, error rate, and
+	// duration metrics are derived from all exported spans, before any
+	// sampling.  The spans are aggregated by name, kind, and whether they
+	// are errors into a delta Count metric named "span.count" and a Summary
+	// metric of their durations in seconds named "span.duration".  The
+	// metrics are recorded every SpanMetricsInterval and when the Exporter
+	// is flushed.  Call Shutdown to stop the goroutine which records them.
+	ExportSpanMetrics bool
+	// SpanMetricsInterval is how often the span metrics are recorded.  By
+	// default, SpanMetricsInterval is 5 seconds, the default harvest
+	// period.
+	SpanMetricsInterval time.Duration
+	// SpanMetricsNameLimit is the maximum number of distinct span names the
+	// span metrics are recorded for.  Spans whose names are first seen
+	// after the limit is reached are aggregated with the name "other".
+	// Instrumentation such as ochttp names spans by URL path, so without a
+	// limit the number of metric time series can grow without bound.  By
+	// default, SpanMetricsNameLimit is 1000.  A negative limit disables it.
+	SpanMetricsNameLimit int
+	// Queue, if set, exports spans, view data, and metrics in a background
+	// goroutine so that OpenCensus is never blocked by the Exporter.  The
+	// exported data must not be modified after it is passed to the
+	// Exporter.  Flush waits for the queued data to be exported.  Call
+	// Shutdown to stop the goroutine.
+	Queue *Queue
+	// ErrorHandler, if set, is called with the errors that occur while
+	// exporting data.  When the Harvester fails to record a span the error
+	// is a *SpanError.  ErrorHandler may be called concurrently.
+	ErrorHandler func(error)
+
+	// distributions translates OpenCensus's cumulative distributions into
+	// delta distributions.
+	distributions distributionCalculator
+	// cardinality tracks the tag sets of views for ViewCardinalityLimit.
+	cardinality cardinalityLimiter
+	// tailSampler is created from TailSampling by sampler.
+	tailSamplerOnce sync.Once
+	tailSampler     *tailSampler
+	// adaptiveSampler is created from AdaptiveSampling by recordSpan.
+	adaptiveSamplerOnce sync.Once
+	adaptiveSampler     *adaptiveSampler
+	// spanMetricsAggregator is created by spanMetrics.
+	spanMetricsOnce       sync.Once
+	spanMetricsAggregator *spanMetrics
+	// exportQueue is created from Queue by queue.
+	queueOnce   sync.Once
+	exportQueue *exportQueue
+	// diskBuffer is set by NewExporterWithOptions when configured with
+	// ConfigDiskBuffer.
+	diskBuffer *diskBuffer
+	// shutdown is set to 1 by Shutdown and must be accessed atomically.
+	shutdown int32
+	// statsLock protects stats.
+	statsLock sync.Mutex
+	stats     Stats
+}
+
+// harvestNower is implemented by *telemetry.Harvester.  It is used to send
+// data when the Exporter is flushed.
+type harvestNower interface {
+	HarvestNow(context.Context)
 }
 
 var emptySpanID trace.SpanID
 
 // NewExporter creates a new Exporter.  serviceName is the name of this service
 // or application.  apiKey is required and refers to a New Relic Insights Insert API key.
+// The options customize the telemetry.Harvester used to send data.  Use
+// NewExporterWithOptions to also customize the Exporter.
 func NewExporter(serviceName, apiKey string, options ...func(*telemetry.Config)) (*Exporter, error) {
-	options = append([]func(*telemetry.Config){
-		func(cfg *telemetry.Config) {
-			cfg.Product = userAgentProduct
-			cfg.ProductVersion = version
-		},
-		telemetry.ConfigAPIKey(apiKey),
-	}, options...)
-	h, err := telemetry.NewHarvester(options...)
-	if nil != err {
-		return nil, err
-	}
-	return &Exporter{
-		Harvester:         h,
-		ServiceName:       serviceName,
-		IgnoreStatusCodes: []int32{5},
-		DeltaCalculator:   cumulative.NewDeltaCalculator(),
-	}, nil
+	return NewExporterWithOptions(serviceName, apiKey, ConfigTelemetry(options...))
+}
+
+// Flush sends all spans and metrics recorded by the Exporter to New Relic,
+// waiting for the data in the Queue to be exported and making the sampling
+// decisions for all traces buffered by TailSampling.  It blocks until the
+// data has been sent or ctx is done, in which case the context's error is
+// returned.  OpenCensus only reports view data to the Exporter once per
+// reporting period (see view.SetReportingPeriod), so view data which has not
+// yet been reported is not sent.
+func (e *Exporter) Flush(ctx context.Context) error {
+	if nil == e {
+		return nil
+	}
+	if q := e.queue(); nil != q {
+		if err := q.flush(ctx); nil != err {
+			return err
+		}
+	}
+	if sm := e.spanMetrics(); nil != sm {
+		sm.flush()
+	}
+	if ts := e.sampler(); nil != ts {
+		ts.flush()
+	}
+	if h, ok := e.Harvester.(harvestNower); ok {
+		h.HarvestNow(ctx)
+	}
+	return ctx.Err()
+}
+
+// shutdownHarvestTimeout limits the final harvest of Shutdown when its
+// context is done before the Queue is drained.
+const shutdownHarvestTimeout = 2 * time.Second
+
+// Shutdown flushes the Exporter and stops it from recording any more data.
+// Later calls to ExportSpan, ExportView, and ExportMetrics do nothing.
+// Unregister the Exporter from OpenCensus before calling Shutdown to avoid
+// losing data reported after the Exporter is shut down.  If ctx is done
+// before the Queue is drained the remaining data is dropped, the data already
+// recorded is sent with a timeout of a few seconds, and the context's error
+// is returned.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	if nil == e {
+		return nil
+	}
+	atomic.StoreInt32(&e.shutdown, 1)
+	var err error
+	if q := e.queue(); nil != q {
+		err = q.shutdown(ctx)
+	}
+	if sm := e.spanMetrics(); nil != sm {
+		sm.shutdown()
+	}
+	if ts := e.sampler(); nil != ts {
+		ts.shutdown()
+	}
+	if as := e.adaptive(); nil != as {
+		as.shutdown()
+	}
+	flushCtx := ctx
+	if nil != ctx.Err() {
+		// The Harvester cannot send anything with a done context, so the
+		// data already recorded is sent with a short timeout instead.
+		var cancel context.CancelFunc
+		flushCtx, cancel = context.WithTimeout(context.Background(), shutdownHarvestTimeout)
+		defer cancel()
+	}
+	if flushErr := e.Flush(flushCtx); nil == err {
+		err = flushErr
+	}
+	if nil != e.diskBuffer {
+		e.diskBuffer.shutdown()
+	}
+	return err
+}
+
+func (e *Exporter) isShutdown() bool {
+	return atomic.LoadInt32(&e.shutdown) == 1
 }
 
 func (e *Exporter) responseCodeIsError(code int32) bool {
@@ -79,27 +281,65 @@ func (e *Exporter) responseCodeIsError(code int32) bool {
 }
 
 // ExportSpan implements trace.Exporter and records spans with the Harvester
-// for later sending to New Relic.
+// for later sending to New Relic.  Annotations, message events, and links
+// are recorded as zero duration child spans of the span they belong to, with
+// a "span.event.type" attribute of "annotation", "message", or "link"
+// respectively.  Link spans reference the linked span with the
+// "link.trace.id", "link.span.id", and "link.type" attributes.
 func (e *Exporter) ExportSpan(s *trace.SpanData) {
 	if nil == e {
 		return
 	}
+	if e.isShutdown() {
+		return
+	}
+	if e.enqueue(func() { e.exportSpan(s) }) {
+		return
+	}
+	e.exportSpan(s)
+}
 
+func (e *Exporter) exportSpan(s *trace.SpanData) {
 	// This is a somewhat expensive call, so be sure to only do this once.
 	isErr := e.responseCodeIsError(s.Status.Code)
 	// Make a new attribute map instead of updating the original in order to
 	// not change the passed attributes.
-	attrs := make(map[string]interface{}, e.spanAttrLen(s.Attributes, isErr))
+	attrs := make(map[string]interface{}, e.spanAttrLen(s, isErr)+len(e.CommonAttributes)+resourceAttrLen(e.Resource))
 	for k, v := range s.Attributes {
 		attrs[k] = v
 	}
+	e.AttributeFilter.apply(attrs)
 	// Preserve any passed `error` attribute.
-	if _, in := s.Attributes["error"]; !in && isErr {
+	if _, in := attrs["error"]; !in && isErr {
 		attrs["error"] = true
 	}
+	// Preserve any passed `span.kind` and `category` attributes.
+	if kind := spanKind(s.SpanKind); "" != kind {
+		if _, in := attrs["span.kind"]; !in {
+			attrs["span.kind"] = kind
+		}
+	}
+	if _, in := attrs["category"]; !in {
+		attrs["category"] = spanCategory(s)
+	}
+	// Preserve any passed `status.code`, `status.name`, and
+	// `error.message` attributes.
+	if 0 != s.Status.Code {
+		if _, in := attrs["status.code"]; !in {
+			attrs["status.code"] = s.Status.Code
+		}
+		if _, in := attrs["status.name"]; !in {
+			attrs["status.name"] = statusCodeName(s.Status.Code)
+		}
+	}
+	if _, in := attrs["error.message"]; !in && isErr && "" != s.Status.Message {
+		attrs["error.message"] = s.Status.Message
+	}
 	// This exporter defines these values, overwrite if they exist.
 	attrs["instrumentation.provider"] = instrumentationProvider
 	attrs["collector.name"] = collectorName
+	addCommonAttributes(attrs, e.CommonAttributes)
+	addResourceAttributes(attrs, e.Resource)
 
 	sp := telemetry.Span{
 		ID:          s.SpanContext.SpanID.String(),
@@ -118,16 +358,113 @@ func (e *Exporter) ExportSpan(s *trace.SpanData) {
 	if nil == e.Harvester {
 		return
 	}
-	e.Harvester.RecordSpan(sp)
+	if sm := e.spanMetrics(); nil != sm {
+		sm.add(spanMetricsKey{name: s.Name, kind: spanKind(s.SpanKind), isErr: isErr}, sp.Duration)
+	}
+	spans := []telemetry.Span{sp}
+	if e.ExportSpanEvents {
+		spans = append(spans, e.spanEvents(s, sp)...)
+	}
+	if ts := e.sampler(); nil != ts {
+		ts.add(spans, isErr || attrs["error"] == true)
+		return
+	}
+	for _, sp := range spans {
+		e.recordSpan(sp, 1)
+	}
+}
+
+// sampler returns the tail sampler created from TailSampling, starting it the
+// first time it is called, or nil if TailSampling is not set.
+func (e *Exporter) sampler() *tailSampler {
+	e.tailSamplerOnce.Do(func() {
+		if nil == e.TailSampling {
+			return
+		}
+		e.tailSampler = newTailSampler(*e.TailSampling, e.recordSpan, func(kept, dropped int64) {
+			e.updateStats(func(s *Stats) {
+				s.TracesKept += kept
+				s.TracesDropped += dropped
+			})
+		})
+		e.tailSampler.start()
+	})
+	return e.tailSampler
+}
+
+// recordSpan records sp with the Harvester after enforcing the New Relic
+// limits on its attributes, reporting any error.  rate is the probability
+// that TailSampling kept the trace of sp.  Spans may be dropped by
+// AdaptiveSampling, whose decisions are independent of those of
+// TailSampling, so the "sampling.rate" attribute is the product of both
+// probabilities.
+func (e *Exporter) recordSpan(sp telemetry.Span, rate float64) {
+	as := e.adaptive()
+	if nil != as {
+		keep, adaptiveRate := as.sample(sp.TraceID)
+		if !keep {
+			e.updateStats(func(s *Stats) { s.SpansSampledOut++ })
+			return
+		}
+		rate *= adaptiveRate
+	}
+	if nil != as || rate < 1 {
+		// Copy the attributes rather than modify the caller's map.
+		attrs := make(map[string]interface{}, len(sp.Attributes)+1)
+		for k, v := range sp.Attributes {
+			attrs[k] = v
+		}
+		attrs[samplingRateAttribute] = rate
+		sp.Attributes = attrs
+	}
+	e.limitSpanAttributes(&sp)
+	if err := e.Harvester.RecordSpan(sp); nil != err {
+		e.updateStats(func(s *Stats) { s.SpanErrors++ })
+		e.handleError(&SpanError{
+			Err:      err,
+			SpanName: sp.Name,
+			TraceID:  sp.TraceID,
+		})
+	}
+}
+
+// adaptive returns the adaptive sampler created from AdaptiveSampling, or nil
+// if AdaptiveSampling is not set.
+func (e *Exporter) adaptive() *adaptiveSampler {
+	e.adaptiveSamplerOnce.Do(func() {
+		if nil != e.AdaptiveSampling {
+			e.adaptiveSampler = newAdaptiveSampler(*e.AdaptiveSampling)
+			e.adaptiveSampler.run()
+		}
+	})
+	return e.adaptiveSampler
 }
 
 // spanAttrLen returns the number of attributes that will be exported based on
-// the OpenCensus attrs and if the span isErr.
-func (e *Exporter) spanAttrLen(attrs map[string]interface{}, isErr bool) int {
+// the OpenCensus span s and if the span isErr.
+func (e *Exporter) spanAttrLen(s *trace.SpanData, isErr bool) int {
+	attrs := s.Attributes
 	l := len(attrs)
 	if _, in := attrs["error"]; !in && isErr {
 		l++
 	}
+	if _, in := attrs["span.kind"]; !in && "" != spanKind(s.SpanKind) {
+		l++
+	}
+	if _, in := attrs["category"]; !in {
+		l++
+	}
+	if 0 != s.Status.Code {
+		if _, in := attrs["status.code"]; !in {
+			l++
+		}
+		if _, in := attrs["status.name"]; !in {
+			l++
+		}
+	}
+	if _, in := attrs["error.message"]; !in && isErr && "" != s.Status.Message {
+		l++
+	}
 	if _, in := attrs["instrumentation.provider"]; !in {
 		l++
 	}
@@ -137,20 +474,77 @@ func (e *Exporter) spanAttrLen(attrs map[string]interface{}, isErr bool) int {
 	return l
 }
 
-func (e *Exporter) recordCountData(vd *view.Data, data *view.CountData, attrs map[string]interface{}) {
-	metric, ok := e.DeltaCalculator.CountMetric(vd.View.Name, attrs, float64(data.Value), vd.End)
-	if !ok {
-		metric.Name = vd.View.Name
-		metric.Attributes = attrs
-		metric.Value = float64(data.Value)
-		metric.Timestamp = vd.Start
-		metric.Interval = vd.End.Sub(vd.Start)
+// spanKind returns the New Relic span.kind for the OpenCensus span kind, or
+// the empty string if the kind is unspecified.
+func spanKind(kind int) string {
+	switch kind {
+	case trace.SpanKindServer:
+		return "server"
+	case trace.SpanKindClient:
+		return "client"
+	default:
+		return ""
 	}
-	e.Harvester.RecordMetric(metric)
+}
+
+// spanCategory returns the New Relic category of the span.  Spans with
+// database attributes are "datastore" spans.  Client spans created by ochttp,
+// which have "http." attributes, and by ocgrpc, whose names start with
+// "Sent.", are external "http" spans.  All other spans are "generic".
+func spanCategory(s *trace.SpanData) string {
+	var isHTTP bool
+	for k := range s.Attributes {
+		if strings.HasPrefix(k, "db.") || k == "sql.query" {
+			return "datastore"
+		}
+		if strings.HasPrefix(k, "http.") {
+			isHTTP = true
+		}
+	}
+	if s.SpanKind == trace.SpanKindClient && (isHTTP || strings.HasPrefix(s.Name, "Sent.")) {
+		return "http"
+	}
+	return "generic"
+}
+
+// statusCodeNames are the names of the canonical status codes defined in
+// https://github.com/googleapis/googleapis/blob/master/google/rpc/code.proto
+// indexed by code.
+var statusCodeNames = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// statusCodeName returns the name of the canonical status code, or the code
+// itself if it is not a canonical code.
+func statusCodeName(code int32) string {
+	if code >= 0 && int(code) < len(statusCodeNames) {
+		return statusCodeNames[code]
+	}
+	return strconv.Itoa(int(code))
+}
+
+func (e *Exporter) recordCountData(vd *view.Data, data *view.CountData, attrs map[string]interface{}) {
+	e.recordCumulative(vd.View.Name, attrs, float64(data.Value), vd.Start, vd.End)
 }
 
 func (e *Exporter) recordLastValueData(vd *view.Data, data *view.LastValueData, attrs map[string]interface{}) {
-	e.Harvester.RecordMetric(telemetry.Gauge{
+	e.recordMetric(telemetry.Gauge{
 		Name:       vd.View.Name,
 		Attributes: attrs,
 		Value:      data.Value,
@@ -159,13 +553,83 @@ func (e *Exporter) recordLastValueData(vd *view.Data, data *view.LastValueData,
 }
 
 func (e *Exporter) recordSumData(vd *view.Data, data *view.SumData, attrs map[string]interface{}) {
-	metric, ok := e.DeltaCalculator.CountMetric(vd.View.Name, attrs, data.Value, vd.End)
+	e.recordCumulative(vd.View.Name, attrs, data.Value, vd.Start, vd.End)
+}
+
+func (e *Exporter) recordDistributionData(vd *view.Data, data *view.DistributionData, attrs map[string]interface{}) {
+	d := distributionFromView(vd.View.Aggregation.Buckets, data)
+	e.recordDistribution(vd.View.Name, attrs, d, vd.Start, vd.End)
+}
+
+// recordDistribution records the cumulative distribution d, which started at
+// start, as of now.
+func (e *Exporter) recordDistribution(name string, attrs map[string]interface{}, d distribution, start, now time.Time) {
+	if e.ExportDistributionBuckets {
+		e.recordDistributionBuckets(name, attrs, d, start, now)
+	}
+	delta, deltaStart, ok := e.distributions.delta(name, attrs, d, now)
+	if !ok {
+		delta = d
+		deltaStart = start
+	}
+	// A summary without any values has no meaningful min and max.
+	if delta.count <= 0 {
+		return
+	}
+	e.recordMetric(telemetry.Summary{
+		Name:       name,
+		Attributes: attrs,
+		Count:      float64(delta.count),
+		Sum:        delta.sum,
+		Min:        delta.min,
+		Max:        delta.max,
+		Timestamp:  deltaStart,
+		Interval:   now.Sub(deltaStart),
+	})
+	if !delta.hasBuckets() {
+		return
+	}
+	for _, p := range e.DistributionPercentiles {
+		if p <= 0 || p > 100 {
+			continue
+		}
+		e.recordMetric(telemetry.Gauge{
+			Name:       percentileMetricName(name, p),
+			Attributes: attrs,
+			Value:      delta.percentile(p),
+			Timestamp:  now,
+		})
+	}
+}
+
+func (e *Exporter) recordDistributionBuckets(name string, attrs map[string]interface{}, d distribution, start, now time.Time) {
+	if !d.hasBuckets() {
+		return
+	}
+	name += bucketsMetricSuffix
+	for i, count := range d.buckets {
+		bucketAttrs := make(map[string]interface{}, len(attrs)+1)
+		for k, v := range attrs {
+			bucketAttrs[k] = v
+		}
+		bucketAttrs["le"] = bucketBoundary(d.bounds, i)
+		e.recordCumulative(name, bucketAttrs, float64(count), start, now)
+	}
+}
+
+// recordCumulative records the delta of the cumulative value val, which
+// started at start, as of now.
+func (e *Exporter) recordCumulative(name string, attrs map[string]interface{}, val float64, start, now time.Time) {
+	// The DeltaCalculator serializes the attributes, so the limits must be
+	// enforced first.
+	attrs = e.limitMetricAttributes(attrs)
+	metric, ok := e.DeltaCalculator.CountMetric(name, attrs, val, now)
 	if !ok {
-		metric.Name = vd.View.Name
+		metric.Name = name
 		metric.Attributes = attrs
-		metric.Value = data.Value
-		metric.Timestamp = vd.Start
-		metric.Interval = vd.End.Sub(vd.Start)
+		metric.Value = val
+		metric.Timestamp = start
+		metric.Interval = now.Sub(start)
 	}
 	e.Harvester.RecordMetric(metric)
 }
@@ -176,14 +640,33 @@ func (e *Exporter) ExportView(vd *view.Data) {
 	if nil == e {
 		return
 	}
+	if e.isShutdown() {
+		return
+	}
 	if nil == e.Harvester {
 		return
 	}
 	if nil == e.DeltaCalculator {
 		return
 	}
-	for _, row := range vd.Rows {
-		attrs := make(map[string]interface{}, len(row.Tags)+5)
+	if e.enqueue(func() { e.exportView(vd) }) {
+		return
+	}
+	e.exportView(vd)
+}
+
+func (e *Exporter) exportView(vd *view.Data) {
+	if vd = e.applyViewRules(vd); nil == vd {
+		return
+	}
+	vd = e.convertUnits(vd)
+	vd = e.filterViewTags(vd)
+	rows, merged := e.limitCardinality(vd)
+	if merged > 0 {
+		e.recordCardinalityOverflow(vd, merged)
+	}
+	for _, row := range rows {
+		attrs := make(map[string]interface{}, len(row.Tags)+5+len(e.CommonAttributes)+resourceAttrLen(e.Resource))
 		for _, tag := range row.Tags {
 			attrs[tag.Key.Name()] = tag.Value
 		}
@@ -192,6 +675,8 @@ func (e *Exporter) ExportView(vd *view.Data) {
 		attrs["measure.name"] = vd.View.Measure.Name()
 		attrs["measure.unit"] = vd.View.Measure.Unit()
 		attrs["service.name"] = e.ServiceName
+		addCommonAttributes(attrs, e.CommonAttributes)
+		addResourceAttributes(attrs, e.Resource)
 
 		switch data := row.Data.(type) {
 		case *view.CountData:
@@ -201,6 +686,7 @@ func (e *Exporter) ExportView(vd *view.Data) {
 		case *view.LastValueData:
 			e.recordLastValueData(vd, data, attrs)
 		case *view.DistributionData:
+			e.recordDistributionData(vd, data, attrs)
 		default:
 		}
 	}
@@ -4,13 +4,20 @@
 package nrcensus
 
 import (
+	"context"
 	"encoding/json"
+	"math"
 	"reflect"
+	"regexp"
 	"testing"
 	"time"
 
 	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricexport"
+	"go.opencensus.io/resource"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
@@ -43,8 +50,8 @@ var (
 	}
 	testDistributionView = &view.View{
 		Measure:     testMeasure,
-		Name:        "MyTestLastValue",
-		Description: "a sum of the test",
+		Name:        "MyTestDistribution",
+		Description: "a distribution of the test",
 		Aggregation: view.Distribution(25, 100, 200, 400, 800, 10000),
 		TagKeys:     []tag.Key{testKeyFirst, testKeySecond},
 	}
@@ -359,6 +366,15 @@ func TestDistributionMetrics(t *testing.T) {
 		DeltaCalculator: cumulative.NewDeltaCalculator(),
 	}
 
+	// first time metric is seen
+	data := &view.DistributionData{
+		Count:           5,
+		Min:             1,
+		Max:             20000,
+		Mean:            1234,
+		SumOfSquaredDev: 123123123,
+		CountPerBucket:  []int64{1, 2, 0, 0, 0, 0, 2},
+	}
 	vd := &view.Data{
 		View:  testDistributionView,
 		Start: testTime,
@@ -369,20 +385,891 @@ func TestDistributionMetrics(t *testing.T) {
 					tag.Tag{Key: testKeyFirst, Value: "firstValue"},
 					tag.Tag{Key: testKeySecond, Value: "secondValue"},
 				},
-				Data: &view.DistributionData{
-					Count:           5,
-					Min:             1,
-					Max:             20000,
-					Mean:            1234,
-					SumOfSquaredDev: 123123123,
-					CountPerBucket:  []int64{1, 2, 0, 0, 0, 0, 2},
+				Data: data,
+			},
+		},
+	}
+	exp.ExportView(vd)
+
+	// second time metric is seen values are added but min and max do not
+	// change
+	vd.End = testTime.Add(20 * time.Second)
+	data.Count = 7
+	data.Mean = 1000
+	data.CountPerBucket = []int64{1, 2, 0, 1, 0, 0, 3}
+	exp.ExportView(vd)
+
+	// third time metric is seen nothing changes
+	vd.End = testTime.Add(30 * time.Second)
+	exp.ExportView(vd)
+
+	// fourth time metric is seen min and max change
+	vd.End = testTime.Add(40 * time.Second)
+	data.Count = 9
+	data.Min = 0.5
+	data.Max = 30000
+	data.CountPerBucket = []int64{2, 2, 0, 1, 0, 0, 4}
+	exp.ExportView(vd)
+
+	attrs := map[string]interface{}{
+		"first":                    "firstValue",
+		"second":                   "secondValue",
+		"instrumentation.provider": instrumentationProvider,
+		"collector.name":           collectorName,
+		"measure.name":             "tests",
+		"measure.unit":             "t",
+		"service.name":             "serviceName",
+	}
+	want := []telemetry.Metric{
+		telemetry.Summary{
+			Name:       "MyTestDistribution",
+			Attributes: attrs,
+			Count:      5,
+			Sum:        6170,
+			Min:        1,
+			Max:        20000,
+			Timestamp:  testTime,
+			Interval:   10 * time.Second,
+		},
+		telemetry.Summary{
+			Name:       "MyTestDistribution",
+			Attributes: attrs,
+			Count:      2,
+			Sum:        830,
+			Min:        200,
+			Max:        20000,
+			Timestamp:  testTime.Add(10 * time.Second),
+			Interval:   10 * time.Second,
+		},
+		telemetry.Summary{
+			Name:       "MyTestDistribution",
+			Attributes: attrs,
+			Count:      2,
+			Sum:        2000,
+			Min:        0.5,
+			Max:        30000,
+			Timestamp:  testTime.Add(30 * time.Second),
+			Interval:   10 * time.Second,
+		},
+	}
+	if !reflect.DeepEqual(h.metrics, want) {
+		t.Errorf("metrics are incorrect:\ngot  %#v\nwant %#v", h.metrics, want)
+	}
+}
+
+func TestDistributionDeltaReset(t *testing.T) {
+	var dc distributionCalculator
+	bounds := []float64{10}
+	if _, _, ok := dc.delta("m", nil, distribution{count: 5, sum: 10, bounds: bounds, buckets: []int64{5, 0}}, testTime); ok {
+		t.Error("first distribution should not be valid")
+	}
+	// the cumulative count going backwards means the distribution was reset
+	if _, _, ok := dc.delta("m", nil, distribution{count: 1, sum: 1, bounds: bounds, buckets: []int64{1, 0}}, testTime.Add(time.Second)); ok {
+		t.Error("reset distribution should not be valid")
+	}
+	delta, start, ok := dc.delta("m", nil, distribution{count: 3, sum: 21, min: 1, max: 15, bounds: bounds, buckets: []int64{1, 2}}, testTime.Add(2*time.Second))
+	if !ok {
+		t.Fatal("distribution after reset should be valid")
+	}
+	if start != testTime.Add(time.Second) {
+		t.Errorf("incorrect start time: %v", start)
+	}
+	if want := (distribution{count: 2, sum: 20, min: 10, max: 15, bounds: bounds, buckets: []int64{0, 2}}); !reflect.DeepEqual(delta, want) {
+		t.Errorf("incorrect delta: got %#v, want %#v", delta, want)
+	}
+}
+
+func TestDistributionBucketMetrics(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:                 h,
+		ServiceName:               "serviceName",
+		DeltaCalculator:           cumulative.NewDeltaCalculator(),
+		ExportDistributionBuckets: true,
+	}
+
+	data := &view.DistributionData{
+		Count:          5,
+		Min:            1,
+		Max:            20000,
+		Mean:           1234,
+		CountPerBucket: []int64{1, 2, 0, 0, 0, 0, 2},
+	}
+	vd := &view.Data{
+		View:  testDistributionView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows:  []*view.Row{&view.Row{Data: data}},
+	}
+	exp.ExportView(vd)
+
+	vd.End = testTime.Add(20 * time.Second)
+	data.Count = 7
+	data.Mean = 1000
+	data.CountPerBucket = []int64{1, 2, 0, 1, 0, 0, 3}
+	exp.ExportView(vd)
+
+	var counts []telemetry.Count
+	for _, m := range h.metrics {
+		if c, ok := m.(telemetry.Count); ok {
+			counts = append(counts, c)
+		}
+	}
+	if len(counts) != 14 {
+		t.Fatalf("incorrect number of bucket metrics: %d", len(counts))
+	}
+	wantBounds := []string{"25", "100", "200", "400", "800", "10000", "+Inf"}
+	wantCumulative := []float64{1, 2, 0, 0, 0, 0, 2}
+	for i, c := range counts[:7] {
+		if c.Name != "MyTestDistribution.buckets" {
+			t.Errorf("incorrect bucket metric name: %s", c.Name)
+		}
+		if le := c.Attributes["le"]; le != wantBounds[i] {
+			t.Errorf("incorrect le attribute for bucket %d: %v", i, le)
+		}
+		if c.Value != wantCumulative[i] {
+			t.Errorf("incorrect cumulative bucket %d value: %f", i, c.Value)
+		}
+		if c.Timestamp != testTime || c.Interval != 10*time.Second {
+			t.Errorf("incorrect bucket %d timing: %v %v", i, c.Timestamp, c.Interval)
+		}
+	}
+	wantDeltas := []float64{0, 0, 0, 1, 0, 0, 1}
+	for i, c := range counts[7:] {
+		if c.Value != wantDeltas[i] {
+			t.Errorf("incorrect delta bucket %d value: %f", i, c.Value)
+		}
+		if c.Timestamp != testTime.Add(10*time.Second) || c.Interval != 10*time.Second {
+			t.Errorf("incorrect bucket %d timing: %v %v", i, c.Timestamp, c.Interval)
+		}
+	}
+}
+
+func TestDistributionPercentileMetrics(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:               h,
+		ServiceName:             "serviceName",
+		DeltaCalculator:         cumulative.NewDeltaCalculator(),
+		DistributionPercentiles: []float64{50, 90, 99.9, 150},
+	}
+
+	data := &view.DistributionData{
+		Count:          10,
+		Min:            10,
+		Max:            20000,
+		Mean:           1000,
+		CountPerBucket: []int64{2, 4, 2, 0, 1, 0, 1},
+	}
+	vd := &view.Data{
+		View:  testDistributionView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows:  []*view.Row{&view.Row{Data: data}},
+	}
+	exp.ExportView(vd)
+
+	// only the values added since the previous export are used
+	vd.End = testTime.Add(20 * time.Second)
+	data.Count = 14
+	data.CountPerBucket = []int64{2, 4, 2, 4, 1, 0, 1}
+	exp.ExportView(vd)
+
+	var gauges []telemetry.Gauge
+	for _, m := range h.metrics {
+		if g, ok := m.(telemetry.Gauge); ok {
+			gauges = append(gauges, g)
+		}
+	}
+	want := []struct {
+		name  string
+		value float64
+	}{
+		// 5th value is the 3rd of 4 values in the [25, 100) bucket
+		{"MyTestDistribution.p50", 81.25},
+		// 9th value is the only value in the [400, 800) bucket
+		{"MyTestDistribution.p90", 800},
+		// last bucket is clamped to the max
+		{"MyTestDistribution.p99.9", 19900},
+		// all new values are in the [200, 400) bucket
+		{"MyTestDistribution.p50", 300},
+		{"MyTestDistribution.p90", 380},
+		{"MyTestDistribution.p99.9", 399.8},
+	}
+	if len(gauges) != len(want) {
+		t.Fatalf("incorrect number of percentile metrics: %#v", gauges)
+	}
+	for i, w := range want {
+		g := gauges[i]
+		if g.Name != w.name || math.Abs(g.Value-w.value) > 1e-9 {
+			t.Errorf("incorrect percentile metric: got %s=%f, want %s=%f", g.Name, g.Value, w.name, w.value)
+		}
+	}
+}
+
+var _ metricexport.Exporter = &Exporter{}
+
+func TestExportMetricsNilExporter(t *testing.T) {
+	var exp *Exporter
+	if err := exp.ExportMetrics(context.Background(), []*metricdata.Metric{nil}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExportMetrics(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+	}
+	labelKeys := []metricdata.LabelKey{{Key: "first"}, {Key: "second"}}
+	labelValues := []metricdata.LabelValue{metricdata.NewLabelValue("firstValue"), {}}
+	newMetric := func(name string, typ metricdata.Type, points ...metricdata.Point) *metricdata.Metric {
+		return &metricdata.Metric{
+			Descriptor: metricdata.Descriptor{
+				Name:      name,
+				Unit:      metricdata.UnitMilliseconds,
+				Type:      typ,
+				LabelKeys: labelKeys,
+			},
+			TimeSeries: []*metricdata.TimeSeries{{
+				LabelValues: labelValues,
+				Points:      points,
+				StartTime:   testTime,
+			}},
+		}
+	}
+	dist := func(count int64, sum float64, buckets ...int64) *metricdata.Distribution {
+		d := &metricdata.Distribution{
+			Count:         count,
+			Sum:           sum,
+			BucketOptions: &metricdata.BucketOptions{Bounds: []float64{10, 100}},
+		}
+		for _, c := range buckets {
+			d.Buckets = append(d.Buckets, metricdata.Bucket{Count: c})
+		}
+		return d
+	}
+	first := testTime.Add(10 * time.Second)
+	second := testTime.Add(20 * time.Second)
+
+	err := exp.ExportMetrics(context.Background(), []*metricdata.Metric{
+		newMetric("gauge", metricdata.TypeGaugeInt64, metricdata.NewInt64Point(first, 7)),
+		newMetric("cumulative", metricdata.TypeCumulativeFloat64,
+			metricdata.NewFloat64Point(first, 10),
+			metricdata.NewFloat64Point(second, 15)),
+		newMetric("distribution", metricdata.TypeCumulativeDistribution,
+			metricdata.NewDistributionPoint(first, dist(2, 30, 1, 1, 0)),
+			metricdata.NewDistributionPoint(second, dist(3, 80, 1, 2, 0))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := map[string]interface{}{
+		"first":                    "firstValue",
+		"instrumentation.provider": instrumentationProvider,
+		"collector.name":           collectorName,
+		"measure.unit":             "ms",
+		"service.name":             "serviceName",
+	}
+	attrsJSON := json.RawMessage(`{"collector.name":"` + collectorName + `","first":"firstValue","instrumentation.provider":"` + instrumentationProvider + `","measure.unit":"ms","service.name":"serviceName"}`)
+	want := []telemetry.Metric{
+		telemetry.Gauge{
+			Name:       "gauge",
+			Attributes: attrs,
+			Value:      7,
+			Timestamp:  first,
+		},
+		telemetry.Count{
+			Name:       "cumulative",
+			Attributes: attrs,
+			Value:      10,
+			Timestamp:  testTime,
+			Interval:   10 * time.Second,
+		},
+		telemetry.Count{
+			Name:           "cumulative",
+			AttributesJSON: attrsJSON,
+			Value:          5,
+			Timestamp:      first,
+			Interval:       10 * time.Second,
+		},
+		telemetry.Summary{
+			Name:       "distribution",
+			Attributes: attrs,
+			Count:      2,
+			Sum:        30,
+			Min:        10,
+			Max:        100,
+			Timestamp:  testTime,
+			Interval:   10 * time.Second,
+		},
+		telemetry.Summary{
+			Name:       "distribution",
+			Attributes: attrs,
+			Count:      1,
+			Sum:        50,
+			Min:        10,
+			Max:        100,
+			Timestamp:  first,
+			Interval:   10 * time.Second,
+		},
+	}
+	if !reflect.DeepEqual(h.metrics, want) {
+		t.Errorf("metrics are incorrect:\ngot  %#v\nwant %#v", h.metrics, want)
+	}
+}
+
+func TestDistributionFromMetricdataMinMax(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Count    int64
+		Sum      float64
+		Buckets  []int64
+		Min, Max float64
+	}{
+		{Name: "middle", Count: 2, Sum: 100, Buckets: []int64{0, 2, 0}, Min: 10, Max: 100},
+		{Name: "first", Count: 2, Sum: 10, Buckets: []int64{2, 0, 0}, Min: 5, Max: 10},
+		{Name: "last", Count: 2, Sum: 300, Buckets: []int64{0, 0, 2}, Min: 100, Max: 150},
+		{Name: "first and last", Count: 2, Sum: 205, Buckets: []int64{1, 0, 1}, Min: 10, Max: 102.5},
+		{Name: "mean outside edges", Count: 2, Sum: 151, Buckets: []int64{1, 0, 1}, Min: 10, Max: 100},
+	}
+	for _, test := range tests {
+		data := &metricdata.Distribution{
+			Count:         test.Count,
+			Sum:           test.Sum,
+			BucketOptions: &metricdata.BucketOptions{Bounds: []float64{10, 100}},
+		}
+		for _, c := range test.Buckets {
+			data.Buckets = append(data.Buckets, metricdata.Bucket{Count: c})
+		}
+		d := distributionFromMetricdata(data)
+		if d.min != test.Min || d.max != test.Max {
+			t.Errorf("%s: min, max = %v, %v, want %v, %v", test.Name, d.min, d.max, test.Min, test.Max)
+		}
+	}
+}
+
+func TestExportMetricsUsingOpenCensusAPI(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+	}
+	r := metric.NewRegistry()
+	g, err := r.AddInt64Gauge("queue.size", metric.WithLabelKeys("queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := g.GetEntry(metricdata.NewLabelValue("orders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Set(12)
+
+	if err := exp.ExportMetrics(context.Background(), r.Read()); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.metrics) != 1 {
+		t.Fatalf("incorrect number of metrics: %#v", h.metrics)
+	}
+	gauge, ok := h.metrics[0].(telemetry.Gauge)
+	if !ok || gauge.Name != "queue.size" || gauge.Value != 12 || gauge.Attributes["queue"] != "orders" {
+		t.Errorf("gauge is incorrect: %#v", h.metrics[0])
+	}
+}
+
+func TestMetricResource(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+		Resource: &resource.Resource{
+			Type:   "host",
+			Labels: map[string]string{"host.name": "my-host", "first": "resourceValue"},
+		},
+	}
+	exp.ExportView(&view.Data{
+		View:  testLastValueView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows: []*view.Row{
+			&view.Row{
+				Tags: []tag.Tag{tag.Tag{Key: testKeyFirst, Value: "firstValue"}},
+				Data: &view.LastValueData{Value: 10},
+			},
+		},
+	})
+	exp.ExportMetrics(context.Background(), []*metricdata.Metric{{
+		Descriptor: metricdata.Descriptor{Name: "gauge", Type: metricdata.TypeGaugeFloat64},
+		Resource: &resource.Resource{
+			Type:   "k8s",
+			Labels: map[string]string{"k8s.pod.name": "my-pod"},
+		},
+		TimeSeries: []*metricdata.TimeSeries{{
+			Points: []metricdata.Point{metricdata.NewFloat64Point(testTime, 1)},
+		}},
+	}})
+
+	viewAttrs := h.metrics[0].(telemetry.Gauge).Attributes
+	if viewAttrs["first"] != "firstValue" || viewAttrs["host.name"] != "my-host" || viewAttrs["resource.type"] != "host" {
+		t.Errorf("view metric attributes are incorrect: %#v", viewAttrs)
+	}
+	metricAttrs := h.metrics[1].(telemetry.Gauge).Attributes
+	if metricAttrs["k8s.pod.name"] != "my-pod" || metricAttrs["host.name"] != "my-host" || metricAttrs["resource.type"] != "k8s" {
+		t.Errorf("metricdata attributes are incorrect: %#v", metricAttrs)
+	}
+}
+
+func TestMetricCommonAttributes(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+		CommonAttributes: map[string]interface{}{
+			"environment":  "production",
+			"first":        "commonValue",
+			"service.name": "other",
+		},
+		Resource: &resource.Resource{
+			Labels: map[string]string{"environment": "staging"},
+		},
+	}
+	exp.ExportView(&view.Data{
+		View:  testLastValueView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows: []*view.Row{
+			&view.Row{
+				Tags: []tag.Tag{tag.Tag{Key: testKeyFirst, Value: "firstValue"}},
+				Data: &view.LastValueData{Value: 10},
+			},
+		},
+	})
+	exp.ExportMetrics(context.Background(), []*metricdata.Metric{{
+		Descriptor: metricdata.Descriptor{Name: "gauge", Type: metricdata.TypeGaugeFloat64},
+		Resource: &resource.Resource{
+			Labels: map[string]string{"environment": "development"},
+		},
+		TimeSeries: []*metricdata.TimeSeries{{
+			Points: []metricdata.Point{metricdata.NewFloat64Point(testTime, 1)},
+		}},
+	}})
+
+	viewAttrs := h.metrics[0].(telemetry.Gauge).Attributes
+	if viewAttrs["first"] != "firstValue" || viewAttrs["environment"] != "production" || viewAttrs["service.name"] != "serviceName" {
+		t.Errorf("view metric attributes are incorrect: %#v", viewAttrs)
+	}
+	metricAttrs := h.metrics[1].(telemetry.Gauge).Attributes
+	if metricAttrs["first"] != "commonValue" || metricAttrs["environment"] != "production" || metricAttrs["service.name"] != "serviceName" {
+		t.Errorf("metricdata attributes are incorrect: %#v", metricAttrs)
+	}
+}
+
+func TestMetricAttributeFilter(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+		AttributeFilter: &AttributeFilter{
+			Deny:       []Matcher{Glob("first"), Glob("measure.*")},
+			Redactions: []Redaction{{Redact: MaskEmails}},
+		},
+	}
+	exp.ExportView(&view.Data{
+		View:  testLastValueView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows: []*view.Row{
+			&view.Row{
+				Tags: []tag.Tag{
+					tag.Tag{Key: testKeyFirst, Value: "firstValue"},
+					tag.Tag{Key: testKeySecond, Value: "jane@example.com"},
+				},
+				Data: &view.LastValueData{Value: 10},
+			},
+		},
+	})
+	exp.ExportMetrics(context.Background(), []*metricdata.Metric{{
+		Descriptor: metricdata.Descriptor{
+			Name:      "gauge",
+			Type:      metricdata.TypeGaugeFloat64,
+			LabelKeys: []metricdata.LabelKey{{Key: "first"}, {Key: "second"}},
+		},
+		TimeSeries: []*metricdata.TimeSeries{{
+			LabelValues: []metricdata.LabelValue{
+				metricdata.NewLabelValue("firstValue"),
+				metricdata.NewLabelValue("bob@example.com"),
+			},
+			Points: []metricdata.Point{metricdata.NewFloat64Point(testTime, 1)},
+		}},
+	}})
+
+	for _, m := range h.metrics {
+		attrs := m.(telemetry.Gauge).Attributes
+		if _, in := attrs["first"]; in || attrs["second"] != "[email]" || nil == attrs["measure.unit"] {
+			t.Errorf("metric attributes are incorrect: %#v", attrs)
+		}
+	}
+}
+
+func TestViewAttributeFilterMergesRows(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+		AttributeFilter: &AttributeFilter{Deny: []Matcher{Glob("first")}},
+	}
+	vd := &view.Data{
+		View:  testSumView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows: []*view.Row{
+			testRow("user1", &view.SumData{Value: 10}),
+			testRow("user2", &view.SumData{Value: 5}),
+		},
+	}
+	exp.ExportView(vd)
+
+	vd.End = testTime.Add(20 * time.Second)
+	vd.Rows = []*view.Row{
+		testRow("user1", &view.SumData{Value: 12}),
+		testRow("user2", &view.SumData{Value: 8}),
+	}
+	exp.ExportView(vd)
+
+	if len(h.metrics) != 2 {
+		t.Fatalf("incorrect number of metrics: %#v", h.metrics)
+	}
+	for i, want := range []float64{15, 5} {
+		if c := h.metrics[i].(telemetry.Count); c.Value != want {
+			t.Errorf("metric %d has value %f, want %f", i, c.Value, want)
+		}
+	}
+	if attrs := h.metrics[0].(telemetry.Count).Attributes; nil != attrs["first"] || attrs["second"] != "secondValue" {
+		t.Errorf("metric attributes are incorrect: %#v", attrs)
+	}
+	if vd.Rows[0].Data.(*view.SumData).Value != 12 {
+		t.Error("view data was modified")
+	}
+}
+
+func TestMetricAttributeFilterMergesTimeSeries(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+		AttributeFilter: &AttributeFilter{Deny: []Matcher{Glob("user")}},
+	}
+	export := func(end time.Time, user1, user2 float64) {
+		series := func(user string, val float64) *metricdata.TimeSeries {
+			return &metricdata.TimeSeries{
+				LabelValues: []metricdata.LabelValue{
+					metricdata.NewLabelValue(user),
+					metricdata.NewLabelValue("GET"),
 				},
+				Points:    []metricdata.Point{metricdata.NewFloat64Point(end, val)},
+				StartTime: testTime,
+			}
+		}
+		exp.ExportMetrics(context.Background(), []*metricdata.Metric{{
+			Descriptor: metricdata.Descriptor{
+				Name:      "requests",
+				Type:      metricdata.TypeCumulativeFloat64,
+				LabelKeys: []metricdata.LabelKey{{Key: "user"}, {Key: "method"}},
+			},
+			TimeSeries: []*metricdata.TimeSeries{series("user1", user1), series("user2", user2)},
+		}})
+	}
+	export(testTime.Add(10*time.Second), 10, 5)
+	export(testTime.Add(20*time.Second), 12, 8)
+
+	if len(h.metrics) != 2 {
+		t.Fatalf("incorrect number of metrics: %#v", h.metrics)
+	}
+	for i, want := range []float64{15, 5} {
+		if c := h.metrics[i].(telemetry.Count); c.Value != want {
+			t.Errorf("metric %d has value %f, want %f", i, c.Value, want)
+		}
+	}
+	if attrs := h.metrics[0].(telemetry.Count).Attributes; nil != attrs["user"] || attrs["method"] != "GET" {
+		t.Errorf("metric attributes are incorrect: %#v", attrs)
+	}
+}
+
+func TestMergePoint(t *testing.T) {
+	later := testTime.Add(time.Second)
+	if p := mergePoint(metricdata.TypeGaugeInt64, metricdata.NewInt64Point(later, 1), metricdata.NewInt64Point(testTime, 2)); p.Value != int64(1) {
+		t.Errorf("gauge not taken from the later point: %#v", p)
+	}
+	dist := func(values ...float64) *metricdata.Distribution {
+		d := &metricdata.Distribution{
+			BucketOptions: &metricdata.BucketOptions{Bounds: []float64{10}},
+			Buckets:       []metricdata.Bucket{{}, {}},
+		}
+		for _, v := range values {
+			d.Count++
+			d.Sum += v
+			if v < 10 {
+				d.Buckets[0].Count++
+			} else {
+				d.Buckets[1].Count++
+			}
+		}
+		mean := d.Sum / float64(d.Count)
+		for _, v := range values {
+			d.SumOfSquaredDeviation += (v - mean) * (v - mean)
+		}
+		return d
+	}
+	x, y := dist(1, 3), dist(5, 15)
+	p := mergePoint(metricdata.TypeCumulativeDistribution,
+		metricdata.NewDistributionPoint(testTime, x), metricdata.NewDistributionPoint(later, y))
+	if want := dist(1, 3, 5, 15); p.Time != later || !reflect.DeepEqual(p.Value, want) {
+		t.Errorf("incorrect merged distribution: %#v", p)
+	}
+	if x.Count != 2 || x.Buckets[0].Count != 2 {
+		t.Errorf("distribution modified: %#v", x)
+	}
+}
+
+func testRow(first string, data view.AggregationData) *view.Row {
+	return &view.Row{
+		Tags: []tag.Tag{
+			tag.Tag{Key: testKeyFirst, Value: first},
+			tag.Tag{Key: testKeySecond, Value: "secondValue"},
+		},
+		Data: data,
+	}
+}
+
+func TestViewCardinalityLimit(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:            h,
+		ServiceName:          "serviceName",
+		DeltaCalculator:      cumulative.NewDeltaCalculator(),
+		ViewCardinalityLimit: 2,
+	}
+	exp.ExportView(&view.Data{
+		View:  testSumView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows: []*view.Row{
+			testRow("a", &view.SumData{Value: 1}),
+			testRow("b", &view.SumData{Value: 2}),
+			testRow("c", &view.SumData{Value: 4}),
+			testRow("d", &view.SumData{Value: 8}),
+		},
+	})
+	// Tag sets seen before the limit was reached are still exported.
+	exp.ExportView(&view.Data{
+		View:  testSumView,
+		Start: testTime,
+		End:   testTime.Add(20 * time.Second),
+		Rows: []*view.Row{
+			testRow("e", &view.SumData{Value: 16}),
+			testRow("b", &view.SumData{Value: 2}),
+		},
+	})
+
+	values := make(map[string]float64)
+	var overflows []float64
+	for _, m := range h.metrics {
+		switch metric := m.(type) {
+		case telemetry.Count:
+			if nil != metric.Attributes {
+				values[metric.Attributes["first"].(string)] += metric.Value
+			}
+		case telemetry.Gauge:
+			if metric.Name != cardinalityOverflowMetricName || metric.Attributes["view.name"] != "MyTestSum" {
+				t.Errorf("incorrect overflow metric: %#v", metric)
+			}
+			overflows = append(overflows, metric.Value)
+		}
+	}
+	if !reflect.DeepEqual(values, map[string]float64{"a": 1, "b": 2, "other": 12}) {
+		t.Errorf("incorrect values: %v", values)
+	}
+	if !reflect.DeepEqual(overflows, []float64{2, 1}) {
+		t.Errorf("incorrect overflow values: %v", overflows)
+	}
+}
+
+func TestViewCardinalityLimitExpiration(t *testing.T) {
+	exp := &Exporter{
+		Harvester:            &testHarvester{},
+		DeltaCalculator:      cumulative.NewDeltaCalculator(),
+		ViewCardinalityLimit: 1,
+	}
+	exp.cardinality.expirationAge = time.Minute
+	exp.cardinality.expirationCheckInterval = time.Minute
+	admitted := func(first string, end time.Time) bool {
+		rows, merged := exp.limitCardinality(&view.Data{
+			View: testSumView,
+			End:  end,
+			Rows: []*view.Row{testRow(first, &view.SumData{Value: 1})},
+		})
+		return 1 == len(rows) && 0 == merged
+	}
+	if !admitted("a", testTime) {
+		t.Error("first tag set not admitted")
+	}
+	if admitted("b", testTime.Add(30*time.Second)) {
+		t.Error("tag set admitted over the limit")
+	}
+	// Tag set "a" stops reporting and is forgotten, making room for "b".
+	if !admitted("b", testTime.Add(5*time.Minute)) {
+		t.Error("tag set not admitted after the old tag set expired")
+	}
+	if admitted("a", testTime.Add(5*time.Minute+time.Second)) {
+		t.Error("expired tag set admitted over the limit")
+	}
+}
+
+func TestMergeDistributionData(t *testing.T) {
+	a := &view.DistributionData{Count: 2, Min: 1, Max: 3, Mean: 2, SumOfSquaredDev: 2, CountPerBucket: []int64{1, 1}}
+	b := &view.DistributionData{Count: 2, Min: 5, Max: 7, Mean: 6, SumOfSquaredDev: 2, CountPerBucket: []int64{0, 2}}
+	merged := mergeAggregationData(copyAggregationData(a), b).(*view.DistributionData)
+	// The values are 1, 3, 5, and 7.
+	if !reflect.DeepEqual(merged, &view.DistributionData{
+		Count:           4,
+		Min:             1,
+		Max:             7,
+		Mean:            4,
+		SumOfSquaredDev: 20,
+		CountPerBucket:  []int64{1, 3},
+	}) {
+		t.Errorf("incorrect merged distribution: %#v", merged)
+	}
+	if a.Count != 2 || a.CountPerBucket[1] != 1 {
+		t.Errorf("original distribution modified: %#v", a)
+	}
+}
+
+func TestViewRules(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+		ViewRules: []ViewRule{
+			{View: Glob("MyTestCount"), Drop: true},
+			{
+				View:       regexp.MustCompile(`^MyTest(Sum|LastValue)$`),
+				Name:       "renamed",
+				DropTags:   []string{"second"},
+				RenameTags: map[string]string{"first": "primary"},
+				Unit:       "ms",
 			},
+			{View: Glob("MyTest*"), Name: "unused"},
+		},
+	}
+	exp.ExportView(&view.Data{
+		View:  testCountView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows:  []*view.Row{testRow("a", &view.CountData{Value: 1})},
+	})
+	secondValue := func(row *view.Row, value string) *view.Row {
+		row.Tags[1].Value = value
+		return row
+	}
+	vd := &view.Data{
+		View:  testSumView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows: []*view.Row{
+			secondValue(testRow("a", &view.SumData{Value: 1}), "x"),
+			secondValue(testRow("a", &view.SumData{Value: 2}), "y"),
+			testRow("b", &view.SumData{Value: 4}),
 		},
 	}
 	exp.ExportView(vd)
 
-	if len(h.metrics) != 0 {
-		t.Errorf("distribution type metrics not yet supported: %#v", h.metrics)
+	if len(h.metrics) != 2 {
+		t.Fatalf("incorrect number of metrics: %#v", h.metrics)
+	}
+	values := make(map[string]float64)
+	for _, m := range h.metrics {
+		metric := m.(telemetry.Count)
+		if metric.Name != "renamed" || metric.Attributes["measure.unit"] != "ms" || metric.Attributes["measure.name"] != "tests" {
+			t.Errorf("incorrect metric: %#v", metric)
+		}
+		if _, in := metric.Attributes["second"]; in {
+			t.Errorf("tag not dropped: %#v", metric.Attributes)
+		}
+		values[metric.Attributes["primary"].(string)] = metric.Value
+	}
+	if !reflect.DeepEqual(values, map[string]float64{"a": 3, "b": 4}) {
+		t.Errorf("incorrect values: %v", values)
+	}
+	if vd.View != testSumView || len(vd.Rows) != 3 || vd.Rows[0].Data.(*view.SumData).Value != 1 {
+		t.Errorf("view data modified: %#v", vd)
+	}
+}
+
+func TestConvertUnits(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+		ConvertUnits:    true,
+		ViewRules: []ViewRule{
+			{View: Glob("MyTestDistribution"), Unit: "ms"},
+			{View: Glob("MyTestLastValue"), Unit: "kBy"},
+		},
+	}
+	distribution := &view.DistributionData{
+		Count:          2,
+		Min:            10,
+		Max:            300,
+		Mean:           155,
+		CountPerBucket: []int64{1, 0, 0, 1, 0, 0, 0},
+	}
+	exp.ExportView(&view.Data{
+		View:  testDistributionView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows:  []*view.Row{testRow("a", distribution)},
+	})
+	exp.ExportView(&view.Data{
+		View:  testLastValueView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows:  []*view.Row{testRow("a", &view.LastValueData{Value: 2})},
+	})
+	exp.ExportView(&view.Data{
+		View:  testCountView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows:  []*view.Row{testRow("a", &view.CountData{Value: 3})},
+	})
+
+	if len(h.metrics) != 3 {
+		t.Fatalf("incorrect number of metrics: %#v", h.metrics)
+	}
+	if summary := h.metrics[0].(telemetry.Summary); summary.Count != 2 ||
+		math.Abs(summary.Sum-0.31) > 1e-9 || summary.Min != 0.01 || summary.Max != 0.3 ||
+		summary.Attributes["measure.unit"] != "s" {
+		t.Errorf("incorrect summary: %#v", summary)
+	}
+	if gauge := h.metrics[1].(telemetry.Gauge); gauge.Value != 2000 || gauge.Attributes["measure.unit"] != "By" {
+		t.Errorf("incorrect gauge: %#v", gauge)
+	}
+	if count := h.metrics[2].(telemetry.Count); count.Value != 3 || count.Attributes["measure.unit"] != "t" {
+		t.Errorf("incorrect count: %#v", count)
+	}
+	if distribution.Min != 10 || testDistributionView.Aggregation.Buckets[0] != 25 {
+		t.Errorf("view data modified")
 	}
 }
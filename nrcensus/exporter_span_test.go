@@ -5,11 +5,13 @@ package nrcensus
 
 import (
 	"context"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/resource"
 	"go.opencensus.io/trace"
 )
 
@@ -64,6 +66,7 @@ func TestSpanGeneric(t *testing.T) {
 			"color":                    "purple",
 			"instrumentation.provider": instrumentationProvider,
 			"collector.name":           collectorName,
+			"category":                 "generic",
 		},
 	}) {
 		t.Errorf("span fields are incorrect: %#v", span)
@@ -103,6 +106,7 @@ func TestSpanParentID(t *testing.T) {
 			"color":                    "purple",
 			"instrumentation.provider": instrumentationProvider,
 			"collector.name":           collectorName,
+			"category":                 "generic",
 		},
 	}) {
 		t.Errorf("span fields are incorrect: %#v", span)
@@ -132,8 +136,11 @@ func TestSpanErrorAttrHonored(t *testing.T) {
 		Duration:    time.Second,
 		Attributes: map[string]interface{}{
 			"error":                    "hello world",
+			"status.code":              int32(1),
+			"status.name":              "CANCELLED",
 			"instrumentation.provider": instrumentationProvider,
 			"collector.name":           collectorName,
+			"category":                 "generic",
 		},
 	}) {
 		t.Errorf("span fields are incorrect: %#v", span)
@@ -160,8 +167,11 @@ func TestSpanErrorIgnoredHonored(t *testing.T) {
 		Timestamp:   testTime,
 		Duration:    time.Second,
 		Attributes: map[string]interface{}{
+			"status.code":              int32(1),
+			"status.name":              "CANCELLED",
 			"instrumentation.provider": instrumentationProvider,
 			"collector.name":           collectorName,
+			"category":                 "generic",
 		},
 	}) {
 		t.Errorf("span fields are incorrect: %#v", span)
@@ -188,8 +198,11 @@ func TestSpanErrorRecorded(t *testing.T) {
 		Duration:    time.Second,
 		Attributes: map[string]interface{}{
 			"error":                    true,
+			"status.code":              int32(1),
+			"status.name":              "CANCELLED",
 			"instrumentation.provider": instrumentationProvider,
 			"collector.name":           collectorName,
+			"category":                 "generic",
 		},
 	}) {
 		t.Errorf("span fields are incorrect: %#v", span)
@@ -218,6 +231,7 @@ func TestSpanInstAttrsOverwritten(t *testing.T) {
 	want := map[string]interface{}{
 		"instrumentation.provider": instrumentationProvider,
 		"collector.name":           collectorName,
+		"category":                 "generic",
 	}
 	for _, s := range h.spans {
 		if !reflect.DeepEqual(s.Attributes, want) {
@@ -271,8 +285,12 @@ func TestSpanUsingOpenCensusAPI(t *testing.T) {
 		Duration:    childSpan.Duration,
 		Attributes: map[string]interface{}{
 			"error":                    true,
+			"status.code":              int32(trace.StatusCodePermissionDenied),
+			"status.name":              "PERMISSION_DENIED",
+			"error.message":            "oops permission denied",
 			"instrumentation.provider": instrumentationProvider,
 			"collector.name":           collectorName,
+			"category":                 "generic",
 		},
 	}) {
 		t.Errorf("child span fields are incorrect: %#v", childSpan)
@@ -290,6 +308,7 @@ func TestSpanUsingOpenCensusAPI(t *testing.T) {
 		Attributes: map[string]interface{}{
 			"instrumentation.provider": instrumentationProvider,
 			"collector.name":           collectorName,
+			"category":                 "generic",
 		},
 	}) {
 		t.Errorf("parent span fields are incorrect: %#v", parentSpan)
@@ -336,6 +355,7 @@ func TestSpanAttrLen(t *testing.T) {
 	tests := []struct {
 		Attrs map[string]interface{}
 		Error bool
+		Kind  int
 		Want  int
 	}{
 		{
@@ -344,7 +364,7 @@ func TestSpanAttrLen(t *testing.T) {
 				"collector.name":           collectorName,
 			},
 			Error: false,
-			Want:  2,
+			Want:  3,
 		},
 		{
 			Attrs: map[string]interface{}{
@@ -352,7 +372,7 @@ func TestSpanAttrLen(t *testing.T) {
 				"collector.name":           collectorName,
 			},
 			Error: true,
-			Want:  3,
+			Want:  4,
 		},
 		{
 			Attrs: map[string]interface{}{
@@ -360,7 +380,7 @@ func TestSpanAttrLen(t *testing.T) {
 				"second key": "second value",
 			},
 			Error: false,
-			Want:  4,
+			Want:  5,
 		},
 		{
 			Attrs: map[string]interface{}{
@@ -368,38 +388,550 @@ func TestSpanAttrLen(t *testing.T) {
 				"second key": "second value",
 			},
 			Error: true,
-			Want:  5,
+			Want:  6,
 		},
 		{
 			Attrs: map[string]interface{}{
 				"error": "some value",
 			},
 			Error: true,
-			Want:  3,
+			Want:  4,
 		},
 		{
 			Attrs: map[string]interface{}{
 				"error": "some value",
 			},
 			Error: false,
-			Want:  3,
+			Want:  4,
 		},
 		{
 			Attrs: map[string]interface{}{},
 			Error: false,
-			Want:  2,
+			Want:  3,
 		},
 		{
 			Attrs: map[string]interface{}{},
 			Error: true,
-			Want:  3,
+			Want:  4,
+		},
+		{
+			Attrs: map[string]interface{}{},
+			Kind:  trace.SpanKindClient,
+			Want:  4,
+		},
+		{
+			Attrs: map[string]interface{}{
+				"span.kind": "producer",
+				"category":  "generic",
+			},
+			Kind: trace.SpanKindClient,
+			Want: 4,
 		},
 	}
 
 	exp := &Exporter{IgnoreStatusCodes: []int32{}}
 	for _, test := range tests {
-		if got := exp.spanAttrLen(test.Attrs, test.Error); got != test.Want {
+		sd := &trace.SpanData{Attributes: test.Attrs, SpanKind: test.Kind}
+		if got := exp.spanAttrLen(sd, test.Error); got != test.Want {
 			t.Errorf("Exporter.spanAttrLen(%#v, %t) = %d, want %d", test.Attrs, test.Error, got, test.Want)
 		}
 	}
 }
+
+func TestSpanEvents(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:        h,
+		ExportSpanEvents: true,
+		ServiceName:      "serviceName",
+	}
+	sd := &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:      "spanName",
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+		Annotations: []trace.Annotation{{
+			Time:       testTime.Add(100 * time.Millisecond),
+			Message:    "something happened",
+			Attributes: map[string]interface{}{"key": "value"},
+		}},
+		MessageEvents: []trace.MessageEvent{{
+			Time:                 testTime.Add(200 * time.Millisecond),
+			EventType:            trace.MessageEventTypeSent,
+			MessageID:            7,
+			UncompressedByteSize: 100,
+			CompressedByteSize:   50,
+		}},
+	}
+	exp.ExportSpan(sd)
+	if len(h.spans) != 3 {
+		t.Fatalf("incorrect number of spans recorded: %#v", h.spans)
+	}
+	if span := h.spans[1]; !reflect.DeepEqual(span, telemetry.Span{
+		ID:          spanEventID(testSpanID, 0),
+		TraceID:     "0102030405060708090a0b0c0d0e0f10",
+		Name:        "something happened",
+		ParentID:    "0102030405060708",
+		ServiceName: "serviceName",
+		Timestamp:   testTime.Add(100 * time.Millisecond),
+		Attributes: map[string]interface{}{
+			"key":                      "value",
+			"span.event.type":          "annotation",
+			"instrumentation.provider": instrumentationProvider,
+			"collector.name":           collectorName,
+		},
+	}) {
+		t.Errorf("annotation span fields are incorrect: %#v", span)
+	}
+	if span := h.spans[2]; !reflect.DeepEqual(span, telemetry.Span{
+		ID:          spanEventID(testSpanID, 1),
+		TraceID:     "0102030405060708090a0b0c0d0e0f10",
+		Name:        "message.sent",
+		ParentID:    "0102030405060708",
+		ServiceName: "serviceName",
+		Timestamp:   testTime.Add(200 * time.Millisecond),
+		Attributes: map[string]interface{}{
+			"span.event.type":           "message",
+			"message.id":                int64(7),
+			"message.size.uncompressed": int64(100),
+			"message.size.compressed":   int64(50),
+			"instrumentation.provider":  instrumentationProvider,
+			"collector.name":            collectorName,
+		},
+	}) {
+		t.Errorf("message event span fields are incorrect: %#v", span)
+	}
+	if spanEventID(testSpanID, 0) == spanEventID(testSpanID, 1) {
+		t.Error("span event IDs are not unique")
+	}
+}
+
+func TestSpanEventsDisabled(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{Harvester: h}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:          "spanName",
+		StartTime:     testTime,
+		EndTime:       testTime.Add(time.Second),
+		Annotations:   []trace.Annotation{{Time: testTime, Message: "annotation"}},
+		MessageEvents: []trace.MessageEvent{{Time: testTime, EventType: trace.MessageEventTypeSent}},
+	})
+	if len(h.spans) != 1 {
+		t.Errorf("span events exported when disabled: %#v", h.spans)
+	}
+}
+
+func TestSpanEventsUnnamedAnnotation(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{Harvester: h, ExportSpanEvents: true}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:        "spanName",
+		StartTime:   testTime,
+		EndTime:     testTime.Add(time.Second),
+		Annotations: []trace.Annotation{{Time: testTime}},
+	})
+	if len(h.spans) != 2 {
+		t.Fatalf("incorrect number of spans recorded: %#v", h.spans)
+	}
+	if name := h.spans[1].Name; name != "annotation" {
+		t.Errorf("unnamed annotation span has name %q, want %q", name, "annotation")
+	}
+}
+
+func TestSpanKindAndCategory(t *testing.T) {
+	tests := []struct {
+		Name         string
+		SpanKind     int
+		Attrs        map[string]interface{}
+		WantKind     interface{}
+		WantCategory interface{}
+	}{
+		{
+			Name:         "unspecified",
+			WantKind:     nil,
+			WantCategory: "generic",
+		},
+		{
+			Name:         "ochttp server",
+			SpanKind:     trace.SpanKindServer,
+			Attrs:        map[string]interface{}{"http.method": "GET"},
+			WantKind:     "server",
+			WantCategory: "generic",
+		},
+		{
+			Name:         "ochttp client",
+			SpanKind:     trace.SpanKindClient,
+			Attrs:        map[string]interface{}{"http.url": "https://example.com"},
+			WantKind:     "client",
+			WantCategory: "http",
+		},
+		{
+			Name:         "Sent.helloworld.Greeter.SayHello",
+			SpanKind:     trace.SpanKindClient,
+			WantKind:     "client",
+			WantCategory: "http",
+		},
+		{
+			Name:         "sql:query",
+			SpanKind:     trace.SpanKindClient,
+			Attrs:        map[string]interface{}{"sql.query": "SELECT 1"},
+			WantKind:     "client",
+			WantCategory: "datastore",
+		},
+		{
+			Name:         "passed attributes",
+			SpanKind:     trace.SpanKindClient,
+			Attrs:        map[string]interface{}{"span.kind": "producer", "category": "custom"},
+			WantKind:     "producer",
+			WantCategory: "custom",
+		},
+	}
+
+	for _, test := range tests {
+		h := &testHarvester{}
+		exp := &Exporter{
+			Harvester:   h,
+			ServiceName: "serviceName",
+		}
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: testTraceID,
+			},
+			Name:       test.Name,
+			SpanKind:   test.SpanKind,
+			StartTime:  testTime,
+			EndTime:    testTime.Add(time.Second),
+			Attributes: test.Attrs,
+		})
+		attrs := h.spans[0].Attributes
+		if kind := attrs["span.kind"]; kind != test.WantKind {
+			t.Errorf("%s: incorrect span.kind: got %v, want %v", test.Name, kind, test.WantKind)
+		}
+		if category := attrs["category"]; category != test.WantCategory {
+			t.Errorf("%s: incorrect category: got %v, want %v", test.Name, category, test.WantCategory)
+		}
+	}
+}
+
+func TestSpanStatus(t *testing.T) {
+	tests := []struct {
+		Status trace.Status
+		Attrs  map[string]interface{}
+		Want   map[string]interface{}
+	}{
+		{
+			Status: trace.Status{Code: trace.StatusCodeDeadlineExceeded, Message: "too slow"},
+			Want: map[string]interface{}{
+				"status.code":   int32(trace.StatusCodeDeadlineExceeded),
+				"status.name":   "DEADLINE_EXCEEDED",
+				"error.message": "too slow",
+			},
+		},
+		{
+			// NOT_FOUND is ignored by default so is not an error
+			Status: trace.Status{Code: trace.StatusCodeNotFound, Message: "no such thing"},
+			Want: map[string]interface{}{
+				"status.code":   int32(trace.StatusCodeNotFound),
+				"status.name":   "NOT_FOUND",
+				"error.message": nil,
+			},
+		},
+		{
+			Status: trace.Status{Code: 42},
+			Want: map[string]interface{}{
+				"status.code":   int32(42),
+				"status.name":   "42",
+				"error.message": nil,
+			},
+		},
+		{
+			Status: trace.Status{Code: trace.StatusCodeInternal, Message: "oops"},
+			Attrs:  map[string]interface{}{"error.message": "passed message"},
+			Want: map[string]interface{}{
+				"status.code":   int32(trace.StatusCodeInternal),
+				"status.name":   "INTERNAL",
+				"error.message": "passed message",
+			},
+		},
+		{
+			Status: trace.Status{Message: "ok"},
+			Want: map[string]interface{}{
+				"status.code":   nil,
+				"status.name":   nil,
+				"error.message": nil,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		h := &testHarvester{}
+		exp := &Exporter{
+			Harvester:         h,
+			ServiceName:       "serviceName",
+			IgnoreStatusCodes: []int32{trace.StatusCodeNotFound},
+		}
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: testTraceID,
+			},
+			StartTime:  testTime,
+			EndTime:    testTime.Add(time.Second),
+			Attributes: test.Attrs,
+			Status:     test.Status,
+		})
+		attrs := h.spans[0].Attributes
+		for k, want := range test.Want {
+			if got := attrs[k]; got != want {
+				t.Errorf("status %#v: incorrect %s attribute: got %#v, want %#v", test.Status, k, got, want)
+			}
+		}
+	}
+}
+
+func TestSpanLinks(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:        h,
+		ExportSpanEvents: true,
+		ServiceName:      "serviceName",
+	}
+	sd := &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:      "consume",
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+		Links: []trace.Link{{
+			TraceID:    trace.TraceID{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			SpanID:     testParentID,
+			Type:       trace.LinkTypeParent,
+			Attributes: map[string]interface{}{"queue": "orders"},
+		}},
+	}
+	exp.ExportSpan(sd)
+	if len(h.spans) != 2 {
+		t.Fatalf("incorrect number of spans recorded: %#v", h.spans)
+	}
+	if span := h.spans[1]; !reflect.DeepEqual(span, telemetry.Span{
+		ID:          spanEventID(testSpanID, 0),
+		TraceID:     "0102030405060708090a0b0c0d0e0f10",
+		Name:        "link",
+		ParentID:    "0102030405060708",
+		ServiceName: "serviceName",
+		Timestamp:   testTime,
+		Attributes: map[string]interface{}{
+			"queue":                    "orders",
+			"span.event.type":          "link",
+			"link.trace.id":            "100f0e0d0c0b0a090807060504030201",
+			"link.span.id":             "090a0b0c0d0e0f10",
+			"link.type":                "parent",
+			"instrumentation.provider": instrumentationProvider,
+			"collector.name":           collectorName,
+		},
+	}) {
+		t.Errorf("link span fields are incorrect: %#v", span)
+	}
+}
+
+func TestSpanResource(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:        h,
+		ExportSpanEvents: true,
+		ServiceName:      "serviceName",
+		Resource: &resource.Resource{
+			Type: "host",
+			Labels: map[string]string{
+				"host.name": "my-host",
+				"color":     "red",
+			},
+		},
+	}
+	sd := &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:      "spanName",
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+		Attributes: map[string]interface{}{
+			"color": "purple",
+		},
+		Annotations: []trace.Annotation{{Time: testTime, Message: "annotation"}},
+	}
+	exp.ExportSpan(sd)
+	if attrs := h.spans[0].Attributes; !reflect.DeepEqual(attrs, map[string]interface{}{
+		"color":                    "purple",
+		"host.name":                "my-host",
+		"resource.type":            "host",
+		"instrumentation.provider": instrumentationProvider,
+		"collector.name":           collectorName,
+		"category":                 "generic",
+	}) {
+		t.Errorf("span attributes are incorrect: %#v", attrs)
+	}
+	if attrs := h.spans[1].Attributes; attrs["host.name"] != "my-host" || attrs["resource.type"] != "host" {
+		t.Errorf("span event attributes are incorrect: %#v", attrs)
+	}
+}
+
+func TestSpanCommonAttributes(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:        h,
+		ExportSpanEvents: true,
+		ServiceName:      "serviceName",
+		CommonAttributes: map[string]interface{}{
+			"environment":    "production",
+			"color":          "green",
+			"collector.name": "other",
+		},
+		Resource: &resource.Resource{
+			Labels: map[string]string{"environment": "staging", "host.name": "my-host"},
+		},
+	}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:        "spanName",
+		StartTime:   testTime,
+		EndTime:     testTime.Add(time.Second),
+		Attributes:  map[string]interface{}{"color": "purple"},
+		Annotations: []trace.Annotation{{Time: testTime, Message: "annotation"}},
+	})
+	if attrs := h.spans[0].Attributes; !reflect.DeepEqual(attrs, map[string]interface{}{
+		"color":                    "purple",
+		"environment":              "production",
+		"host.name":                "my-host",
+		"instrumentation.provider": instrumentationProvider,
+		"collector.name":           collectorName,
+		"category":                 "generic",
+	}) {
+		t.Errorf("span attributes are incorrect: %#v", attrs)
+	}
+	if attrs := h.spans[1].Attributes; attrs["environment"] != "production" || attrs["color"] != "green" {
+		t.Errorf("span event attributes are incorrect: %#v", attrs)
+	}
+}
+
+func TestSpanAttributeFilter(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:        h,
+		ExportSpanEvents: true,
+		ServiceName:      "serviceName",
+		CommonAttributes: map[string]interface{}{"user.team": "a"},
+		AttributeFilter: &AttributeFilter{
+			Deny:       []Matcher{Glob("user.*"), Glob("error")},
+			Redactions: []Redaction{{Keys: Glob("http.url"), Redact: StripQueryString}},
+		},
+	}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:      "spanName",
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+		Status:    trace.Status{Code: 2},
+		Attributes: map[string]interface{}{
+			"http.url": "/search?q=secret",
+			"user.id":  "123",
+			"error":    false,
+		},
+		Annotations: []trace.Annotation{{
+			Time:       testTime,
+			Message:    "annotation",
+			Attributes: map[string]interface{}{"user.id": "123", "http.url": "/a?b=c"},
+		}},
+	})
+	if attrs := h.spans[0].Attributes; !reflect.DeepEqual(attrs, map[string]interface{}{
+		"http.url":                 "/search",
+		"user.team":                "a",
+		"error":                    true,
+		"status.code":              int32(2),
+		"status.name":              "UNKNOWN",
+		"instrumentation.provider": instrumentationProvider,
+		"collector.name":           collectorName,
+		"category":                 "generic",
+	}) {
+		t.Errorf("span attributes are incorrect: %#v", attrs)
+	}
+	if attrs := h.spans[1].Attributes; attrs["http.url"] != "/a" || attrs["user.team"] != "a" {
+		t.Errorf("span event attributes are incorrect: %#v", attrs)
+	}
+	if _, in := h.spans[1].Attributes["user.id"]; in {
+		t.Errorf("span event attributes not filtered: %#v", h.spans[1].Attributes)
+	}
+}
+
+type errHarvester struct {
+	testHarvester
+	err error
+}
+
+func (h *errHarvester) RecordSpan(sp telemetry.Span) error {
+	return h.err
+}
+
+func TestSpanRecordError(t *testing.T) {
+	recordErr := errors.New("invalid span")
+	h := &errHarvester{err: recordErr}
+	var handled []error
+	exp := &Exporter{
+		Harvester:        h,
+		ExportSpanEvents: true,
+		ServiceName:      "serviceName",
+		ErrorHandler:     func(err error) { handled = append(handled, err) },
+	}
+	sd := &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:        "spanName",
+		StartTime:   testTime,
+		EndTime:     testTime.Add(time.Second),
+		Annotations: []trace.Annotation{{Time: testTime, Message: "annotation"}},
+	}
+	exp.ExportSpan(sd)
+
+	if len(handled) != 2 {
+		t.Fatalf("incorrect number of errors handled: %#v", handled)
+	}
+	spanErr, ok := handled[0].(*SpanError)
+	if !ok {
+		t.Fatalf("incorrect error type: %#v", handled[0])
+	}
+	if spanErr.SpanName != "spanName" || spanErr.TraceID != "0102030405060708090a0b0c0d0e0f10" {
+		t.Errorf("incorrect span error fields: %#v", spanErr)
+	}
+	if !errors.Is(spanErr, recordErr) {
+		t.Errorf("span error does not wrap the harvester error: %v", spanErr)
+	}
+	if want := `unable to record span "spanName" of trace "0102030405060708090a0b0c0d0e0f10": invalid span`; spanErr.Error() != want {
+		t.Errorf("incorrect error message: %s", spanErr.Error())
+	}
+	if stats := exp.Stats(); stats.SpanErrors != 2 {
+		t.Errorf("incorrect span error count: %d", stats.SpanErrors)
+	}
+}
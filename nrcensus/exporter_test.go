@@ -0,0 +1,435 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/resource"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+func TestNewExporterResourceFromEnv(t *testing.T) {
+	os.Setenv(resource.EnvVarType, "host")
+	os.Setenv(resource.EnvVarLabels, `host.name="my-host",region="us-east-1"`)
+	defer os.Unsetenv(resource.EnvVarType)
+	defer os.Unsetenv(resource.EnvVarLabels)
+
+	exp, err := NewExporter("serviceName", "apiKey", telemetry.ConfigHarvestPeriod(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exp.Resource, &resource.Resource{
+		Type: "host",
+		Labels: map[string]string{
+			"host.name": "my-host",
+			"region":    "us-east-1",
+		},
+	}) {
+		t.Errorf("incorrect resource: %#v", exp.Resource)
+	}
+}
+
+func TestNewExporterInvalidResourceLabels(t *testing.T) {
+	os.Setenv(resource.EnvVarLabels, `host.name=unquoted`)
+	defer os.Unsetenv(resource.EnvVarLabels)
+
+	var errs []error
+	exp, err := NewExporterWithOptions("serviceName", "apiKey",
+		ConfigErrorHandler(func(err error) { errs = append(errs, err) }),
+		ConfigTelemetry(telemetry.ConfigHarvestPeriod(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.Resource != nil {
+		t.Errorf("unexpected resource: %#v", exp.Resource)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected one error for invalid resource labels: %v", errs)
+	}
+}
+
+type flushHarvester struct {
+	testHarvester
+	harvests int
+}
+
+func (h *flushHarvester) HarvestNow(ctx context.Context) {
+	h.harvests++
+}
+
+func TestFlush(t *testing.T) {
+	h := &flushHarvester{}
+	exp := &Exporter{
+		Harvester:   h,
+		ServiceName: "serviceName",
+	}
+	if err := exp.Flush(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if h.harvests != 1 {
+		t.Errorf("incorrect number of harvests: %d", h.harvests)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := exp.Flush(ctx); err != context.Canceled {
+		t.Errorf("incorrect error for cancelled context: %v", err)
+	}
+}
+
+func TestFlushSendsData(t *testing.T) {
+	var spanPosts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spanPosts++
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	exp, err := NewExporter("serviceName", "apiKey",
+		telemetry.ConfigHarvestPeriod(0),
+		telemetry.ConfigSpansURLOverride(srv.URL),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:      "spanName",
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+	})
+	if err := exp.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if spanPosts != 1 {
+		t.Errorf("incorrect number of span posts: %d", spanPosts)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h := &flushHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+	}
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if h.harvests != 1 {
+		t.Errorf("incorrect number of harvests: %d", h.harvests)
+	}
+
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+	})
+	exp.ExportView(&view.Data{
+		View:  testCountView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows:  []*view.Row{&view.Row{Data: &view.CountData{Value: 10}}},
+	})
+	exp.ExportMetrics(context.Background(), []*metricdata.Metric{{
+		Descriptor: metricdata.Descriptor{Name: "gauge", Type: metricdata.TypeGaugeFloat64},
+		TimeSeries: []*metricdata.TimeSeries{{
+			Points: []metricdata.Point{metricdata.NewFloat64Point(testTime, 1)},
+		}},
+	}})
+	if len(h.spans) != 0 || len(h.metrics) != 0 {
+		t.Errorf("data recorded after shutdown: %#v %#v", h.spans, h.metrics)
+	}
+}
+
+func TestFlushNilExporter(t *testing.T) {
+	var exp *Exporter
+	if err := exp.Flush(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewExporterWithOptions(t *testing.T) {
+	var handled error
+	res := &resource.Resource{Type: "host"}
+	exp, err := NewExporterWithOptions("serviceName", "apiKey",
+		ConfigIgnoreStatusCodes(5, 16),
+		ConfigDeltaExpiration(time.Hour, time.Minute),
+		ConfigResource(res),
+		ConfigDistributionBuckets(true),
+		ConfigDistributionPercentiles(50, 99),
+		ConfigSpanEvents(true),
+		ConfigCommonAttributes(map[string]interface{}{"environment": "staging", "team": "a"}),
+		ConfigCommonAttributes(map[string]interface{}{"environment": "production"}),
+		ConfigErrorHandler(func(err error) { handled = err }),
+		ConfigTelemetry(telemetry.ConfigHarvestPeriod(0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := exp.Harvester.(*telemetry.Harvester); !ok {
+		t.Errorf("incorrect harvester: %#v", exp.Harvester)
+	}
+	if exp.ServiceName != "serviceName" {
+		t.Errorf("incorrect service name: %s", exp.ServiceName)
+	}
+	if !reflect.DeepEqual(exp.IgnoreStatusCodes, []int32{5, 16}) {
+		t.Errorf("incorrect ignored status codes: %v", exp.IgnoreStatusCodes)
+	}
+	if nil == exp.DeltaCalculator {
+		t.Error("delta calculator not set")
+	}
+	if exp.distributions.expirationAge != time.Hour || exp.distributions.expirationCheckInterval != time.Minute {
+		t.Errorf("incorrect distribution expiration: %v %v",
+			exp.distributions.expirationAge, exp.distributions.expirationCheckInterval)
+	}
+	if exp.cardinality.expirationAge != time.Hour || exp.cardinality.expirationCheckInterval != time.Minute {
+		t.Errorf("incorrect cardinality expiration: %v %v",
+			exp.cardinality.expirationAge, exp.cardinality.expirationCheckInterval)
+	}
+	if exp.Resource != res {
+		t.Errorf("incorrect resource: %#v", exp.Resource)
+	}
+	if !exp.ExportDistributionBuckets {
+		t.Error("distribution buckets not enabled")
+	}
+	if !reflect.DeepEqual(exp.DistributionPercentiles, []float64{50, 99}) {
+		t.Errorf("incorrect percentiles: %v", exp.DistributionPercentiles)
+	}
+	if !exp.ExportSpanEvents {
+		t.Error("span events not enabled")
+	}
+	if !reflect.DeepEqual(exp.CommonAttributes, map[string]interface{}{"environment": "production", "team": "a"}) {
+		t.Errorf("incorrect common attributes: %v", exp.CommonAttributes)
+	}
+	exp.handleError(errors.New("oops"))
+	if nil == handled {
+		t.Error("error handler not set")
+	}
+}
+
+func TestNewExporterDefaults(t *testing.T) {
+	exp, err := NewExporter("serviceName", "apiKey", telemetry.ConfigHarvestPeriod(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exp.IgnoreStatusCodes, []int32{5}) {
+		t.Errorf("incorrect ignored status codes: %v", exp.IgnoreStatusCodes)
+	}
+	if nil == exp.DeltaCalculator {
+		t.Error("delta calculator not set")
+	}
+	if exp.distributions.expirationAge != defaultDeltaExpirationAge {
+		t.Errorf("incorrect distribution expiration age: %v", exp.distributions.expirationAge)
+	}
+}
+
+func TestNewExporterInvalidOptions(t *testing.T) {
+	_, err := NewExporterWithOptions("serviceName", "apiKey",
+		ConfigIgnoreStatusCodes(-1),
+		ConfigDeltaExpiration(0, time.Minute),
+		ConfigDistributionPercentiles(0, 101),
+		ConfigTelemetry(telemetry.ConfigHarvestPeriod(0)),
+	)
+	want := "invalid exporter config: ignored status code -1 is not a positive status code; " +
+		"delta expiration age 0s must be positive; " +
+		"distribution percentile 0 is not between 0 and 100; " +
+		"distribution percentile 101 is not between 0 and 100"
+	if err == nil || err.Error() != want {
+		t.Errorf("incorrect error:\ngot  %v\nwant %s", err, want)
+	}
+}
+
+func TestNewExporterInvalidViewRules(t *testing.T) {
+	_, err := NewExporterWithOptions("serviceName", "apiKey",
+		ConfigViewRules(
+			ViewRule{Name: "renamed"},
+			ViewRule{View: Glob("*"), RenameTags: map[string]string{"first": ""}},
+		),
+		ConfigTelemetry(telemetry.ConfigHarvestPeriod(0)),
+	)
+	want := `invalid exporter config: view rule has no View matcher; ` +
+		`view rule renames tag "first" to invalid key ""`
+	if err == nil || err.Error() != want {
+		t.Errorf("incorrect error:\ngot  %v\nwant %s", err, want)
+	}
+}
+
+func TestNewExporterMissingAPIKey(t *testing.T) {
+	if _, err := NewExporterWithOptions("serviceName", "", ConfigTelemetry(telemetry.ConfigHarvestPeriod(0))); err == nil {
+		t.Error("expected an error for a missing API key")
+	}
+}
+
+func TestConfigEndpoints(t *testing.T) {
+	us, _ := RegionUS.Endpoints()
+	eu, _ := RegionEU.Endpoints()
+	fedramp, _ := RegionFedRAMP.Endpoints()
+	custom := Endpoints{SpansURL: "http://localhost/spans", MetricsURL: "http://localhost/metrics"}
+	testcases := []struct {
+		Name    string
+		APIKey  string
+		Options []Option
+		Want    Endpoints
+		WantOK  bool
+	}{
+		{Name: "default", APIKey: "apiKey", WantOK: false},
+		{Name: "eu key", APIKey: "eu01xx0123456789", Want: eu, WantOK: true},
+		{Name: "us", APIKey: "apiKey", Options: []Option{ConfigRegion(RegionUS)}, Want: us, WantOK: true},
+		{Name: "region wins over key", APIKey: "eu01xx0123456789", Options: []Option{ConfigRegion(RegionFedRAMP)}, Want: fedramp, WantOK: true},
+		{Name: "custom", APIKey: "eu01xx0123456789", Options: []Option{ConfigRegion(RegionUS), ConfigEndpoints(custom)}, Want: custom, WantOK: true},
+	}
+	for _, tc := range testcases {
+		var cfg Config
+		for _, opt := range tc.Options {
+			opt(&cfg)
+		}
+		got, ok := cfg.endpoints(tc.APIKey)
+		if ok != tc.WantOK || got != tc.Want {
+			t.Errorf("%s: incorrect endpoints: got %v %v want %v %v", tc.Name, got, ok, tc.Want, tc.WantOK)
+		}
+	}
+}
+
+func TestNewExporterEndpoints(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	exp, err := NewExporterWithOptions("serviceName", "eu01xx0123456789",
+		ConfigEndpoints(Endpoints{SpansURL: srv.URL + "/spans", MetricsURL: srv.URL + "/metrics"}),
+		ConfigTelemetry(telemetry.ConfigHarvestPeriod(0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{SpanID: testSpanID, TraceID: testTraceID},
+		StartTime:   testTime,
+		EndTime:     testTime.Add(time.Second),
+	})
+	exp.Flush(context.Background())
+	if !reflect.DeepEqual(paths, []string{"/spans"}) {
+		t.Errorf("incorrect requests: %v", paths)
+	}
+}
+
+func TestNewExporterInvalidEndpoints(t *testing.T) {
+	_, err := NewExporterWithOptions("serviceName", "apiKey",
+		ConfigRegion("mars"),
+		ConfigEndpoints(Endpoints{SpansURL: "localhost/spans"}),
+		ConfigTelemetry(telemetry.ConfigHarvestPeriod(0)),
+	)
+	want := `invalid exporter config: region "mars" is not "US", "EU", or "FedRAMP"; ` +
+		`spans URL "localhost/spans" is not an absolute URL; ` +
+		`metrics URL "" is not an absolute URL`
+	if err == nil || err.Error() != want {
+		t.Errorf("incorrect error:\ngot  %v\nwant %s", err, want)
+	}
+}
+
+// setenv sets the environment variables and returns a function which unsets
+// them.
+func setenv(env map[string]string) func() {
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestNewExporterFromEnv(t *testing.T) {
+	var spanPosts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Api-Key") == "apiKey" {
+			spanPosts++
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	defer setenv(map[string]string{
+		EnvAPIKey:            "apiKey",
+		EnvServiceName:       "serviceName",
+		EnvRegion:            "eu",
+		EnvSpansURL:          srv.URL,
+		EnvIgnoreStatusCodes: "5, 16",
+		EnvHarvestPeriod:     "0s",
+		EnvLogLevel:          "error",
+	})()
+	exp, err := NewExporterFromEnv(ConfigDistributionPercentiles(99))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.ServiceName != "serviceName" {
+		t.Errorf("incorrect service name: %s", exp.ServiceName)
+	}
+	if !reflect.DeepEqual(exp.IgnoreStatusCodes, []int32{5, 16}) {
+		t.Errorf("incorrect ignored status codes: %v", exp.IgnoreStatusCodes)
+	}
+	if !reflect.DeepEqual(exp.DistributionPercentiles, []float64{99}) {
+		t.Errorf("options not applied: %v", exp.DistributionPercentiles)
+	}
+
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+	})
+	exp.Flush(context.Background())
+	if spanPosts != 1 {
+		t.Errorf("spans not sent to the overridden URL: %d", spanPosts)
+	}
+}
+
+func TestNewExporterFromEnvErrors(t *testing.T) {
+	defer setenv(map[string]string{
+		EnvRegion:            "mars",
+		EnvMetricsURL:        "metric-api.newrelic.com",
+		EnvIgnoreStatusCodes: "5,NOT_FOUND",
+		EnvHarvestPeriod:     "5",
+		EnvLogLevel:          "verbose",
+	})()
+	_, err := NewExporterFromEnv()
+	want := `invalid environment: NEW_RELIC_API_KEY is not set; ` +
+		`NEW_RELIC_SERVICE_NAME is not set; ` +
+		`NEW_RELIC_REGION "mars" is not "US", "EU", or "FedRAMP"; ` +
+		`NEW_RELIC_METRICS_URL "metric-api.newrelic.com" is not an absolute URL; ` +
+		`NEW_RELIC_IGNORE_STATUS_CODES "5,NOT_FOUND" is not a comma separated list of status codes; ` +
+		`NEW_RELIC_HARVEST_PERIOD "5" is not a non-negative duration; ` +
+		`NEW_RELIC_LOG_LEVEL "verbose" is not "error", "debug", or "audit"`
+	if err == nil || err.Error() != want {
+		t.Errorf("incorrect error:\ngot  %v\nwant %s", err, want)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"regexp"
+	"strings"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Matcher matches strings such as attribute keys.  *regexp.Regexp implements
+// Matcher; use Glob to create a Matcher from a shell pattern.
+type Matcher interface {
+	MatchString(s string) bool
+}
+
+// Glob returns a Matcher which matches the whole string against the shell
+// pattern, where "*" matches any sequence of characters and "?" matches any
+// single character, eg. "http.*".
+func Glob(pattern string) Matcher {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// Redaction rewrites the string values of the attributes whose keys match
+// Keys.
+type Redaction struct {
+	// Keys selects the attributes to redact.  A nil Keys matches all
+	// attributes.
+	Keys Matcher
+	// Redact returns the redacted value, eg. StripQueryString or MaskEmails.
+	Redact func(value string) string
+}
+
+// AttributeFilter removes and redacts the attributes of spans and the tags of
+// views before they are exported.  Attributes defined by the exporter,
+// Exporter.CommonAttributes, and the labels of Exporter.Resource are not
+// filtered.
+type AttributeFilter struct {
+	// Allow, if not empty, removes every attribute whose key does not match
+	// at least one of the Matchers.
+	Allow []Matcher
+	// Deny removes every attribute whose key matches at least one of the
+	// Matchers.  Deny takes precedence over Allow.
+	Deny []Matcher
+	// Redactions are applied in order to the string values of the
+	// attributes which remain.
+	Redactions []Redaction
+}
+
+// keep returns true if the attribute with the given key should be exported.
+func (f *AttributeFilter) keep(key string) bool {
+	for _, m := range f.Deny {
+		if m.MatchString(key) {
+			return false
+		}
+	}
+	if 0 == len(f.Allow) {
+		return true
+	}
+	for _, m := range f.Allow {
+		if m.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact applies the Redactions to the value of the attribute with the given
+// key.
+func (f *AttributeFilter) redact(key string, value string) string {
+	for _, r := range f.Redactions {
+		if nil == r.Redact {
+			continue
+		}
+		if nil == r.Keys || r.Keys.MatchString(key) {
+			value = r.Redact(value)
+		}
+	}
+	return value
+}
+
+// apply filters and redacts attrs in place.  It does nothing if f is nil.
+func (f *AttributeFilter) apply(attrs map[string]interface{}) {
+	if nil == f {
+		return
+	}
+	for k, v := range attrs {
+		if !f.keep(k) {
+			delete(attrs, k)
+			continue
+		}
+		if s, ok := v.(string); ok && len(f.Redactions) > 0 {
+			attrs[k] = f.redact(k, s)
+		}
+	}
+}
+
+// filterViewTags applies the AttributeFilter to the tags of the rows of vd.
+// Rows whose tags are the same once filtered are merged so that the delta
+// metrics calculated for each tag set remain correct.
+func (e *Exporter) filterViewTags(vd *view.Data) *view.Data {
+	f := e.AttributeFilter
+	if nil == f {
+		return vd
+	}
+	v := *vd.View
+	v.TagKeys = nil
+	for _, k := range vd.View.TagKeys {
+		if f.keep(k.Name()) {
+			v.TagKeys = append(v.TagKeys, k)
+		}
+	}
+
+	rows := make([]*view.Row, 0, len(vd.Rows))
+	merged := make(map[string]*view.Row, len(vd.Rows))
+	for _, row := range vd.Rows {
+		tags := make([]tag.Tag, 0, len(row.Tags))
+		for _, t := range row.Tags {
+			name := t.Key.Name()
+			if !f.keep(name) {
+				continue
+			}
+			tags = append(tags, tag.Tag{Key: t.Key, Value: f.redact(name, t.Value)})
+		}
+		id := tagSetKey(tags)
+		if existing, ok := merged[id]; ok {
+			existing.Data = mergeAggregationData(existing.Data, row.Data)
+			continue
+		}
+		newRow := &view.Row{Tags: tags, Data: copyAggregationData(row.Data)}
+		merged[id] = newRow
+		rows = append(rows, newRow)
+	}
+	return &view.Data{View: &v, Start: vd.Start, End: vd.End, Rows: rows}
+}
+
+// filterMetricLabels applies the AttributeFilter to the labels of the time
+// series of m.  Time series whose labels are the same once filtered are
+// merged, in the same manner as filterViewTags, so that the delta metrics
+// calculated for each label set remain correct.
+func (e *Exporter) filterMetricLabels(m *metricdata.Metric) *metricdata.Metric {
+	f := e.AttributeFilter
+	if nil == f {
+		return m
+	}
+	var kept []int
+	desc := m.Descriptor
+	desc.LabelKeys = nil
+	for i, k := range m.Descriptor.LabelKeys {
+		if f.keep(k.Key) {
+			kept = append(kept, i)
+			desc.LabelKeys = append(desc.LabelKeys, k)
+		}
+	}
+
+	series := make([]*metricdata.TimeSeries, 0, len(m.TimeSeries))
+	merged := make(map[string]*metricdata.TimeSeries, len(m.TimeSeries))
+	for _, ts := range m.TimeSeries {
+		if nil == ts {
+			continue
+		}
+		var id strings.Builder
+		values := make([]metricdata.LabelValue, len(kept))
+		for j, i := range kept {
+			if i >= len(ts.LabelValues) || !ts.LabelValues[i].Present {
+				id.WriteByte(0)
+				continue
+			}
+			values[j] = metricdata.NewLabelValue(f.redact(m.Descriptor.LabelKeys[i].Key, ts.LabelValues[i].Value))
+			id.WriteByte(1)
+			id.WriteString(values[j].Value)
+			id.WriteByte(0)
+		}
+		if existing, ok := merged[id.String()]; ok {
+			mergeTimeSeries(desc.Type, existing, ts)
+			continue
+		}
+		newSeries := &metricdata.TimeSeries{
+			LabelValues: values,
+			Points:      append([]metricdata.Point(nil), ts.Points...),
+			StartTime:   ts.StartTime,
+		}
+		merged[id.String()] = newSeries
+		series = append(series, newSeries)
+	}
+	return &metricdata.Metric{Descriptor: desc, Resource: m.Resource, TimeSeries: series}
+}
+
+// StripQueryString removes the query string and fragment from a URL, eg.
+// "/search?q=secret" becomes "/search".  Use it as the Redact function of a
+// Redaction for attributes such as "http.url" and "http.path".
+func StripQueryString(value string) string {
+	if i := strings.IndexAny(value, "?#"); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
+
+// maskedEmail replaces the email addresses found by MaskEmails.
+const maskedEmail = "[email]"
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// MaskEmails replaces every email address in value with "[email]".  Use it as
+// the Redact function of a Redaction.
+func MaskEmails(value string) string {
+	return emailPattern.ReplaceAllString(value, maskedEmail)
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestGlob(t *testing.T) {
+	testcases := []struct {
+		Pattern string
+		Input   string
+		Want    bool
+	}{
+		{Pattern: "http.*", Input: "http.url", Want: true},
+		{Pattern: "http.*", Input: "httpXurl", Want: false},
+		{Pattern: "http.*", Input: "my.http.url", Want: false},
+		{Pattern: "user.?d", Input: "user.id", Want: true},
+		{Pattern: "user.?d", Input: "user.uuid", Want: false},
+		{Pattern: "*", Input: "", Want: true},
+	}
+	for _, tc := range testcases {
+		if got := Glob(tc.Pattern).MatchString(tc.Input); got != tc.Want {
+			t.Errorf("Glob(%q).MatchString(%q) = %t, want %t", tc.Pattern, tc.Input, got, tc.Want)
+		}
+	}
+}
+
+func TestStripQueryString(t *testing.T) {
+	testcases := map[string]string{
+		"/search?q=secret":                    "/search",
+		"https://example.com/a?b=c#d":         "https://example.com/a",
+		"https://example.com/a#section":       "https://example.com/a",
+		"https://example.com/no/query/string": "https://example.com/no/query/string",
+		"":                                    "",
+	}
+	for input, want := range testcases {
+		if got := StripQueryString(input); got != want {
+			t.Errorf("StripQueryString(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestMaskEmails(t *testing.T) {
+	got := MaskEmails("from jane.doe+test@example.co.uk to bob@example.com")
+	if want := "from [email] to [email]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAttributeFilter(t *testing.T) {
+	f := &AttributeFilter{
+		Allow: []Matcher{Glob("http.*"), regexp.MustCompile(`^user\.`)},
+		Deny:  []Matcher{Glob("http.user_agent")},
+		Redactions: []Redaction{
+			{Keys: Glob("http.url"), Redact: StripQueryString},
+			{Redact: MaskEmails},
+		},
+	}
+	attrs := map[string]interface{}{
+		"http.url":        "/search?email=jane@example.com",
+		"http.user_agent": "curl",
+		"http.status":     int64(200),
+		"user.email":      "jane@example.com",
+		"password":        "secret",
+	}
+	f.apply(attrs)
+	if !reflect.DeepEqual(attrs, map[string]interface{}{
+		"http.url":    "/search",
+		"http.status": int64(200),
+		"user.email":  "[email]",
+	}) {
+		t.Errorf("incorrect attributes: %#v", attrs)
+	}
+
+	var nilFilter *AttributeFilter
+	attrs = map[string]interface{}{"password": "secret"}
+	nilFilter.apply(attrs)
+	if len(attrs) != 1 {
+		t.Errorf("nil filter changed attributes: %#v", attrs)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// These limits are enforced by New Relic, which drops or truncates data that
+// exceeds them.
+const (
+	maxAttributeKeyBytes   = 255
+	maxAttributeValueBytes = 4095
+	maxSpanAttributes      = 254
+	maxMetricAttributes    = 100
+)
+
+// spanPriorityAttributes are the attributes defined by the exporter for spans.
+// They are kept in preference to other attributes when a span has too many.
+var spanPriorityAttributes = []string{
+	"instrumentation.provider",
+	"collector.name",
+	"sampling.rate",
+	"error",
+	"error.message",
+	"span.kind",
+	"category",
+	"status.code",
+	"status.name",
+	"span.event.type",
+	"link.trace.id",
+	"link.span.id",
+	"link.type",
+	"message.id",
+	"message.size.uncompressed",
+	"message.size.compressed",
+}
+
+// metricPriorityAttributes are the attributes defined by the exporter for
+// metrics.  They are kept in preference to other attributes when a metric has
+// too many.
+var metricPriorityAttributes = []string{
+	"instrumentation.provider",
+	"collector.name",
+	"service.name",
+	"measure.name",
+	"measure.unit",
+	"le",
+	"span.name",
+	"span.kind",
+	"error",
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a multi-byte
+// character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// limitAttributes returns attrs with keys and string values truncated to the
+// New Relic limits and at most max attributes.  The priority attributes are
+// kept first, followed by the remaining attributes in key order so that the
+// same attributes are always kept.  A key which collides with another after
+// truncation is dropped.  attrs is not modified; if no limits are exceeded it
+// is returned as is.
+func limitAttributes(attrs map[string]interface{}, max int, priority []string) (limited map[string]interface{}, truncated, dropped int64) {
+	needed := len(attrs) > max
+	for k, v := range attrs {
+		if len(k) > maxAttributeKeyBytes {
+			needed = true
+			break
+		}
+		if s, ok := v.(string); ok && len(s) > maxAttributeValueBytes {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return attrs, 0, 0
+	}
+
+	keys := make([]string, 0, len(attrs))
+	isPriority := make(map[string]bool, len(priority))
+	for _, k := range priority {
+		if _, in := attrs[k]; in {
+			keys = append(keys, k)
+			isPriority[k] = true
+		}
+	}
+	rest := len(keys)
+	for k := range attrs {
+		if !isPriority[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys[rest:])
+
+	limited = make(map[string]interface{}, len(attrs))
+	for _, k := range keys {
+		v := attrs[k]
+		if len(limited) >= max {
+			dropped++
+			continue
+		}
+		if len(k) > maxAttributeKeyBytes {
+			k = truncateUTF8(k, maxAttributeKeyBytes)
+			truncated++
+			if _, in := attrs[k]; in {
+				dropped++
+				continue
+			}
+			if _, in := limited[k]; in {
+				dropped++
+				continue
+			}
+		}
+		if s, ok := v.(string); ok && len(s) > maxAttributeValueBytes {
+			v = truncateUTF8(s, maxAttributeValueBytes)
+			truncated++
+		}
+		limited[k] = v
+	}
+	return limited, truncated, dropped
+}
+
+// limitSpanAttributes enforces the New Relic limits on the attributes of sp.
+func (e *Exporter) limitSpanAttributes(sp *telemetry.Span) {
+	var truncated, dropped int64
+	sp.Attributes, truncated, dropped = limitAttributes(sp.Attributes, maxSpanAttributes, spanPriorityAttributes)
+	e.countLimited(truncated, dropped)
+}
+
+// limitMetricAttributes returns attrs with the New Relic limits enforced.
+func (e *Exporter) limitMetricAttributes(attrs map[string]interface{}) map[string]interface{} {
+	limited, truncated, dropped := limitAttributes(attrs, maxMetricAttributes, metricPriorityAttributes)
+	e.countLimited(truncated, dropped)
+	return limited
+}
+
+func (e *Exporter) countLimited(truncated, dropped int64) {
+	if 0 == truncated && 0 == dropped {
+		return
+	}
+	e.updateStats(func(s *Stats) {
+		s.AttributesTruncated += truncated
+		s.AttributesDropped += dropped
+	})
+}
+
+// recordMetric records m with the Harvester after enforcing the New Relic
+// limits on its attributes.
+func (e *Exporter) recordMetric(m telemetry.Metric) {
+	switch metric := m.(type) {
+	case telemetry.Gauge:
+		metric.Attributes = e.limitMetricAttributes(metric.Attributes)
+		m = metric
+	case telemetry.Summary:
+		metric.Attributes = e.limitMetricAttributes(metric.Attributes)
+		m = metric
+	case telemetry.Count:
+		metric.Attributes = e.limitMetricAttributes(metric.Attributes)
+		m = metric
+	}
+	e.Harvester.RecordMetric(m)
+}
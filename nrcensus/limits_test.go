@@ -0,0 +1,149 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+	testcases := []struct {
+		Input string
+		N     int
+		Want  string
+	}{
+		{Input: "abc", N: 5, Want: "abc"},
+		{Input: "abc", N: 2, Want: "ab"},
+		// "é" is two bytes.
+		{Input: "aé", N: 2, Want: "a"},
+		{Input: "aé", N: 3, Want: "aé"},
+	}
+	for _, tc := range testcases {
+		if got := truncateUTF8(tc.Input, tc.N); got != tc.Want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tc.Input, tc.N, got, tc.Want)
+		}
+	}
+}
+
+func TestLimitAttributesUnchanged(t *testing.T) {
+	attrs := map[string]interface{}{"a": "b"}
+	limited, truncated, dropped := limitAttributes(attrs, 1, nil)
+	if !reflect.DeepEqual(limited, attrs) || truncated != 0 || dropped != 0 {
+		t.Errorf("incorrect result: %#v %d %d", limited, truncated, dropped)
+	}
+}
+
+func TestLimitAttributes(t *testing.T) {
+	longKey := strings.Repeat("k", maxAttributeKeyBytes+10)
+	attrs := map[string]interface{}{
+		"priority":                     "kept",
+		"b":                            strings.Repeat("v", maxAttributeValueBytes+1),
+		"a":                            1,
+		longKey:                        "long",
+		longKey[:maxAttributeKeyBytes]: "collides",
+		"x":                            "kept",
+		"y":                            "dropped",
+	}
+	limited, truncated, dropped := limitAttributes(attrs, 5, []string{"priority", "missing"})
+	if !reflect.DeepEqual(limited, map[string]interface{}{
+		"priority":                     "kept",
+		"a":                            1,
+		"b":                            strings.Repeat("v", maxAttributeValueBytes),
+		longKey[:maxAttributeKeyBytes]: "collides",
+		"x":                            "kept",
+	}) {
+		t.Errorf("incorrect attributes: %d", len(limited))
+	}
+	// The value of "b" and the long key are truncated, the long key is
+	// dropped as it collides, and "y" is dropped over the limit.
+	if truncated != 2 || dropped != 2 {
+		t.Errorf("incorrect counts: truncated=%d dropped=%d", truncated, dropped)
+	}
+	if len(attrs) != 7 {
+		t.Errorf("attributes modified: %d", len(attrs))
+	}
+}
+
+func TestSpanAttributeLimits(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:   h,
+		ServiceName: "serviceName",
+	}
+	attrs := make(map[string]interface{}, maxSpanAttributes+10)
+	for i := 0; i < maxSpanAttributes+10; i++ {
+		attrs[fmt.Sprintf("attr%03d", i)] = i
+	}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:       "spanName",
+		StartTime:  testTime,
+		EndTime:    testTime.Add(time.Second),
+		Attributes: attrs,
+	})
+	got := h.spans[0].Attributes
+	if len(got) != maxSpanAttributes {
+		t.Fatalf("incorrect number of attributes: %d", len(got))
+	}
+	for _, k := range []string{"instrumentation.provider", "collector.name", "category", "attr000"} {
+		if _, in := got[k]; !in {
+			t.Errorf("attribute %s missing", k)
+		}
+	}
+	if stats := exp.Stats(); stats.AttributesDropped != 13 || stats.AttributesTruncated != 0 {
+		t.Errorf("incorrect stats: %#v", stats)
+	}
+}
+
+func TestMetricAttributeLimits(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:       h,
+		ServiceName:     "serviceName",
+		DeltaCalculator: cumulative.NewDeltaCalculator(),
+	}
+	long := strings.Repeat("v", maxAttributeValueBytes+1)
+	vd := &view.Data{
+		View:  testCountView,
+		Start: testTime,
+		End:   testTime.Add(10 * time.Second),
+		Rows: []*view.Row{
+			&view.Row{
+				Tags: []tag.Tag{tag.Tag{Key: testKeyFirst, Value: long}},
+				Data: &view.CountData{Value: 5},
+			},
+		},
+	}
+	exp.ExportView(vd)
+	vd.End = vd.End.Add(10 * time.Second)
+	vd.Rows[0].Data = &view.CountData{Value: 7}
+	exp.ExportView(vd)
+
+	if len(h.metrics) != 2 {
+		t.Fatalf("incorrect number of metrics: %d", len(h.metrics))
+	}
+	first := h.metrics[0].(telemetry.Count)
+	if first.Attributes["first"] != long[:maxAttributeValueBytes] {
+		t.Errorf("value not truncated: %d bytes", len(first.Attributes["first"].(string)))
+	}
+	if second := h.metrics[1].(telemetry.Count); second.Value != 2 {
+		t.Errorf("incorrect delta: %#v", second)
+	}
+	if stats := exp.Stats(); stats.AttributesTruncated != 2 {
+		t.Errorf("incorrect stats: %#v", stats)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"context"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/metric/metricdata"
+)
+
+// ExportMetrics implements metricexport.Exporter
+// (https://godoc.org/go.opencensus.io/metric/metricexport#Exporter) and
+// records metrics with the Harvester for later sending to New Relic.  Use it
+// with a metricexport.IntervalReader to export metrics from producers such as
+// metric.Registry.
+//
+// Gauges are recorded as Gauge metrics, cumulative values as delta Count
+// metrics, and distributions as Summary metrics in the same manner as
+// ExportView.  The count and sum of summaries are recorded as delta Count
+// metrics with ".count" and ".sum" suffixes and their percentiles as Gauge
+// metrics.  The labels of the Resource of each metric are added as attributes
+// in the same manner as Exporter.Resource, taking precedence over it but not
+// over Exporter.CommonAttributes.
+//
+// If the IntervalReader also reads the views registered with the view
+// package, do not register this Exporter with view.RegisterExporter as well
+// or the view data will be recorded twice.
+func (e *Exporter) ExportMetrics(ctx context.Context, metrics []*metricdata.Metric) error {
+	if nil == e {
+		return nil
+	}
+	if e.isShutdown() {
+		return nil
+	}
+	if nil == e.Harvester {
+		return nil
+	}
+	if nil == e.DeltaCalculator {
+		return nil
+	}
+	if e.enqueue(func() { e.exportMetrics(metrics) }) {
+		return nil
+	}
+	e.exportMetrics(metrics)
+	return nil
+}
+
+func (e *Exporter) exportMetrics(metrics []*metricdata.Metric) {
+	for _, m := range metrics {
+		if nil == m {
+			continue
+		}
+		m = e.filterMetricLabels(m)
+		for _, ts := range m.TimeSeries {
+			attrs := e.metricAttributes(m, ts)
+			for _, p := range ts.Points {
+				e.recordPoint(m, ts, p, attrs)
+			}
+		}
+	}
+}
+
+func (e *Exporter) metricAttributes(m *metricdata.Metric, ts *metricdata.TimeSeries) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(ts.LabelValues)+4+len(e.CommonAttributes)+resourceAttrLen(m.Resource)+resourceAttrLen(e.Resource))
+	for i, lv := range ts.LabelValues {
+		if !lv.Present || i >= len(m.Descriptor.LabelKeys) {
+			continue
+		}
+		attrs[m.Descriptor.LabelKeys[i].Key] = lv.Value
+	}
+	attrs["instrumentation.provider"] = instrumentationProvider
+	attrs["collector.name"] = collectorName
+	attrs["measure.unit"] = string(m.Descriptor.Unit)
+	attrs["service.name"] = e.ServiceName
+	addCommonAttributes(attrs, e.CommonAttributes)
+	// The resource of the metric is more specific than the resource of the
+	// Exporter.
+	addResourceAttributes(attrs, m.Resource)
+	addResourceAttributes(attrs, e.Resource)
+	return attrs
+}
+
+func (e *Exporter) recordPoint(m *metricdata.Metric, ts *metricdata.TimeSeries, p metricdata.Point, attrs map[string]interface{}) {
+	name := m.Descriptor.Name
+	switch m.Descriptor.Type {
+	case metricdata.TypeGaugeInt64, metricdata.TypeGaugeFloat64:
+		if val, ok := pointValue(p); ok {
+			e.recordMetric(telemetry.Gauge{
+				Name:       name,
+				Attributes: attrs,
+				Value:      val,
+				Timestamp:  p.Time,
+			})
+		}
+	case metricdata.TypeCumulativeInt64, metricdata.TypeCumulativeFloat64:
+		if val, ok := pointValue(p); ok {
+			e.recordCumulative(name, attrs, val, ts.StartTime, p.Time)
+		}
+	case metricdata.TypeGaugeDistribution:
+		data, ok := p.Value.(*metricdata.Distribution)
+		if !ok || data.Count <= 0 {
+			return
+		}
+		d := distributionFromMetricdata(data)
+		e.recordMetric(telemetry.Summary{
+			Name:       name,
+			Attributes: attrs,
+			Count:      float64(d.count),
+			Sum:        d.sum,
+			Min:        d.min,
+			Max:        d.max,
+			Timestamp:  p.Time,
+		})
+	case metricdata.TypeCumulativeDistribution:
+		if data, ok := p.Value.(*metricdata.Distribution); ok {
+			e.recordDistribution(name, attrs, distributionFromMetricdata(data), ts.StartTime, p.Time)
+		}
+	case metricdata.TypeSummary:
+		data, ok := p.Value.(*metricdata.Summary)
+		if !ok {
+			return
+		}
+		if data.HasCountAndSum {
+			e.recordCumulative(name+".count", attrs, float64(data.Count), ts.StartTime, p.Time)
+			e.recordCumulative(name+".sum", attrs, data.Sum, ts.StartTime, p.Time)
+		}
+		for percentile, val := range data.Snapshot.Percentiles {
+			e.recordMetric(telemetry.Gauge{
+				Name:       percentileMetricName(name, percentile),
+				Attributes: attrs,
+				Value:      val,
+				Timestamp:  p.Time,
+			})
+		}
+	}
+}
+
+// mergeTimeSeries adds the points of ts to the points of x, which must have
+// been created by filterMetricLabels.
+func mergeTimeSeries(typ metricdata.Type, x, ts *metricdata.TimeSeries) {
+	if ts.StartTime.Before(x.StartTime) {
+		x.StartTime = ts.StartTime
+	}
+	for i, p := range ts.Points {
+		if i >= len(x.Points) {
+			x.Points = append(x.Points, p)
+			continue
+		}
+		x.Points[i] = mergePoint(typ, x.Points[i], p)
+	}
+}
+
+// mergePoint returns the aggregation of the values of the points a and b.
+// Gauges and the percentiles of summaries cannot be merged, so those of the
+// later point are used.
+func mergePoint(typ metricdata.Type, a, b metricdata.Point) metricdata.Point {
+	later := a
+	if b.Time.After(a.Time) {
+		later = b
+	}
+	if metricdata.TypeGaugeInt64 == typ || metricdata.TypeGaugeFloat64 == typ {
+		return later
+	}
+	p := metricdata.Point{Time: later.Time}
+	switch x := a.Value.(type) {
+	case int64:
+		if y, ok := b.Value.(int64); ok {
+			p.Value = x + y
+			return p
+		}
+	case float64:
+		if y, ok := b.Value.(float64); ok {
+			p.Value = x + y
+			return p
+		}
+	case *metricdata.Distribution:
+		if y, ok := b.Value.(*metricdata.Distribution); ok {
+			p.Value = mergeDistribution(x, y)
+			return p
+		}
+	case *metricdata.Summary:
+		if y, ok := b.Value.(*metricdata.Summary); ok {
+			p.Value = &metricdata.Summary{
+				Count:          x.Count + y.Count,
+				Sum:            x.Sum + y.Sum,
+				HasCountAndSum: x.HasCountAndSum && y.HasCountAndSum,
+				Snapshot:       later.Value.(*metricdata.Summary).Snapshot,
+			}
+			return p
+		}
+	}
+	return later
+}
+
+// mergeDistribution returns the distribution of the values of x and y.  The
+// buckets are only added if both distributions have the same number of them.
+func mergeDistribution(x, y *metricdata.Distribution) *metricdata.Distribution {
+	if 0 == y.Count {
+		return x
+	}
+	if 0 == x.Count {
+		return y
+	}
+	count := x.Count + y.Count
+	delta := y.Sum/float64(y.Count) - x.Sum/float64(x.Count)
+	d := &metricdata.Distribution{
+		Count:                 count,
+		Sum:                   x.Sum + y.Sum,
+		SumOfSquaredDeviation: x.SumOfSquaredDeviation + y.SumOfSquaredDeviation + delta*delta*float64(x.Count)*float64(y.Count)/float64(count),
+		BucketOptions:         x.BucketOptions,
+		Buckets:               append([]metricdata.Bucket(nil), x.Buckets...),
+	}
+	if len(x.Buckets) == len(y.Buckets) {
+		for i, b := range y.Buckets {
+			d.Buckets[i].Count += b.Count
+		}
+	}
+	return d
+}
+
+// pointValue returns the value of an int64 or float64 point.
+func pointValue(p metricdata.Point) (float64, bool) {
+	switch v := p.Value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,422 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/resource"
+)
+
+// Config customizes the behavior of an Exporter created by
+// NewExporterWithOptions.  Most fields correspond to the Exporter field of the
+// same name.
+type Config struct {
+	// IgnoreStatusCodes controls which trace.Status Codes are not turned
+	// into errors on Spans.  By default, IgnoreStatusCodes only includes 5
+	// (NOT_FOUND).
+	IgnoreStatusCodes []int32
+	// DeltaExpirationAge is how long the cumulative values used to
+	// compute delta metrics are kept after they were last seen.  By default,
+	// DeltaExpirationAge is 20 minutes.
+	DeltaExpirationAge time.Duration
+	// DeltaExpirationCheckInterval is how often expired cumulative values
+	// are removed.  By default, DeltaExpirationCheckInterval is 20 minutes.
+	DeltaExpirationCheckInterval time.Duration
+	// Resource describes the entity being monitored.  By default, Resource
+	// is detected from the OC_RESOURCE_TYPE and OC_RESOURCE_LABELS
+	// environment variables.  If they are malformed the error is passed to
+	// the ErrorHandler and no Resource is used.
+	Resource *resource.Resource
+	// ExportDistributionBuckets controls whether the buckets of distribution
+	// views are exported.
+	ExportDistributionBuckets bool
+	// DistributionPercentiles are the percentiles, between 0 and 100, to
+	// compute for distribution views.
+	DistributionPercentiles []float64
+	// ExportSpanEvents controls whether the annotations, message events, and
+	// links of spans are exported as child spans.
+	ExportSpanEvents bool
+	// CommonAttributes are added to all spans and metrics.
+	CommonAttributes map[string]interface{}
+	// AttributeFilter removes and redacts attributes before they are
+	// exported.
+	AttributeFilter *AttributeFilter
+	// ViewCardinalityLimit is the maximum number of distinct tag sets
+	// exported for each view.  By default, there is no limit.
+	ViewCardinalityLimit int
+	// ViewRules rename, drop, and remap the tags of views before they are
+	// exported.
+	ViewRules []ViewRule
+	// ConvertUnits controls whether the values of views are converted to
+	// seconds or bytes.
+	ConvertUnits bool
+	// TailSampling, if set, buffers the spans of each trace and only
+	// records the traces which its policies keep.
+	TailSampling *TailSampling
+	// AdaptiveSampling, if set, records a fraction of spans which is
+	// adjusted to record a target number of spans per minute.
+	AdaptiveSampling *AdaptiveSampling
+	// ExportSpanMetrics controls whether request rate, error rate, and
+	// duration metrics are derived from exported spans.
+	ExportSpanMetrics bool
+	// SpanMetricsInterval is how often the span metrics are recorded.  By
+	// default, SpanMetricsInterval is 5 seconds.
+	SpanMetricsInterval time.Duration
+	// SpanMetricsNameLimit is the maximum number of distinct span names the
+	// span metrics are recorded for.  By default, SpanMetricsNameLimit is
+	// 1000.
+	SpanMetricsNameLimit int
+	// Queue, if set, exports data in a background goroutine.
+	Queue *Queue
+	// DiskBuffer, if set, writes batches of data to disk until they are
+	// sent.
+	DiskBuffer *DiskBuffer
+	// ErrorHandler is called with the errors that occur while exporting
+	// data.
+	ErrorHandler func(error)
+	// Region is the New Relic region that data is sent to.  If neither
+	// Region nor Endpoints are set, the region is detected from the API key
+	// when the key identifies it, and is otherwise RegionUS.
+	Region Region
+	// Endpoints, if set, are custom URLs that data is sent to and take
+	// precedence over Region.
+	Endpoints *Endpoints
+	// TelemetryOptions customize the telemetry.Harvester used to send data.
+	// URL overrides set by these options, such as
+	// telemetry.ConfigSpansURLOverride, take precedence over Region and
+	// Endpoints.
+	TelemetryOptions []func(*telemetry.Config)
+}
+
+// Option customizes the Config of an Exporter created by
+// NewExporterWithOptions.
+type Option func(*Config)
+
+// ConfigIgnoreStatusCodes sets the Config's IgnoreStatusCodes, replacing the
+// default.
+func ConfigIgnoreStatusCodes(codes ...int32) Option {
+	return func(cfg *Config) {
+		cfg.IgnoreStatusCodes = codes
+	}
+}
+
+// ConfigDeltaExpiration sets the Config's DeltaExpirationAge and
+// DeltaExpirationCheckInterval.  Increase these if your metrics are recorded
+// on an intermittent basis to avoid missing metrics or spikes in graphs.
+func ConfigDeltaExpiration(age, checkInterval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.DeltaExpirationAge = age
+		cfg.DeltaExpirationCheckInterval = checkInterval
+	}
+}
+
+// ConfigResource sets the Config's Resource, disabling detection from the
+// environment.
+func ConfigResource(r *resource.Resource) Option {
+	return func(cfg *Config) {
+		cfg.Resource = r
+	}
+}
+
+// ConfigDistributionBuckets sets the Config's ExportDistributionBuckets.
+func ConfigDistributionBuckets(enabled bool) Option {
+	return func(cfg *Config) {
+		cfg.ExportDistributionBuckets = enabled
+	}
+}
+
+// ConfigSpanEvents sets the Config's ExportSpanEvents.
+func ConfigSpanEvents(enabled bool) Option {
+	return func(cfg *Config) {
+		cfg.ExportSpanEvents = enabled
+	}
+}
+
+// ConfigDistributionPercentiles sets the Config's DistributionPercentiles.
+func ConfigDistributionPercentiles(percentiles ...float64) Option {
+	return func(cfg *Config) {
+		cfg.DistributionPercentiles = percentiles
+	}
+}
+
+// ConfigCommonAttributes adds attributes to the Config's CommonAttributes.
+// Later values replace earlier values with the same key.
+func ConfigCommonAttributes(attrs map[string]interface{}) Option {
+	return func(cfg *Config) {
+		if nil == cfg.CommonAttributes {
+			cfg.CommonAttributes = make(map[string]interface{}, len(attrs))
+		}
+		for k, v := range attrs {
+			cfg.CommonAttributes[k] = v
+		}
+	}
+}
+
+// ConfigAttributeFilter sets the Config's AttributeFilter.
+func ConfigAttributeFilter(f *AttributeFilter) Option {
+	return func(cfg *Config) {
+		cfg.AttributeFilter = f
+	}
+}
+
+// ConfigViewCardinalityLimit sets the Config's ViewCardinalityLimit.
+func ConfigViewCardinalityLimit(limit int) Option {
+	return func(cfg *Config) {
+		cfg.ViewCardinalityLimit = limit
+	}
+}
+
+// ConfigViewRules adds rules to the Config's ViewRules.
+func ConfigViewRules(rules ...ViewRule) Option {
+	return func(cfg *Config) {
+		cfg.ViewRules = append(cfg.ViewRules, rules...)
+	}
+}
+
+// ConfigConvertUnits sets the Config's ConvertUnits.
+func ConfigConvertUnits(enabled bool) Option {
+	return func(cfg *Config) {
+		cfg.ConvertUnits = enabled
+	}
+}
+
+// ConfigTailSampling sets the Config's TailSampling.
+func ConfigTailSampling(ts TailSampling) Option {
+	return func(cfg *Config) {
+		cfg.TailSampling = &ts
+	}
+}
+
+// ConfigAdaptiveSampling sets the Config's AdaptiveSampling.
+func ConfigAdaptiveSampling(as AdaptiveSampling) Option {
+	return func(cfg *Config) {
+		cfg.AdaptiveSampling = &as
+	}
+}
+
+// ConfigSpanMetrics sets the Config's ExportSpanMetrics and
+// SpanMetricsInterval.  An interval of zero uses the default.
+func ConfigSpanMetrics(enabled bool, interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ExportSpanMetrics = enabled
+		cfg.SpanMetricsInterval = interval
+	}
+}
+
+// ConfigSpanMetricsNameLimit sets the Config's SpanMetricsNameLimit.  A
+// negative limit disables it.
+func ConfigSpanMetricsNameLimit(limit int) Option {
+	return func(cfg *Config) {
+		cfg.SpanMetricsNameLimit = limit
+	}
+}
+
+// ConfigQueue sets the Config's Queue.
+func ConfigQueue(capacity int, policy QueuePolicy) Option {
+	return func(cfg *Config) {
+		cfg.Queue = &Queue{Capacity: capacity, Policy: policy}
+	}
+}
+
+// ConfigDiskBuffer sets the Config's DiskBuffer.  The disk buffer wraps the
+// transport of the http.Client configured by the telemetry options.
+func ConfigDiskBuffer(db DiskBuffer) Option {
+	return func(cfg *Config) {
+		cfg.DiskBuffer = &db
+	}
+}
+
+// ConfigErrorHandler sets the Config's ErrorHandler.
+func ConfigErrorHandler(handler func(error)) Option {
+	return func(cfg *Config) {
+		cfg.ErrorHandler = handler
+	}
+}
+
+// ConfigRegion sets the Config's Region.
+func ConfigRegion(r Region) Option {
+	return func(cfg *Config) {
+		cfg.Region = r
+	}
+}
+
+// ConfigEndpoints sets the Config's Endpoints to send data to custom URLs.
+func ConfigEndpoints(ep Endpoints) Option {
+	return func(cfg *Config) {
+		cfg.Endpoints = &ep
+	}
+}
+
+// ConfigTelemetry adds options that customize the telemetry.Harvester used to
+// send data, such as telemetry.ConfigHarvestPeriod.
+func ConfigTelemetry(options ...func(*telemetry.Config)) Option {
+	return func(cfg *Config) {
+		cfg.TelemetryOptions = append(cfg.TelemetryOptions, options...)
+	}
+}
+
+// validate returns an error describing every invalid field of the Config.
+func (cfg *Config) validate() error {
+	var problems []string
+	for _, code := range cfg.IgnoreStatusCodes {
+		if code <= 0 {
+			problems = append(problems, fmt.Sprintf("ignored status code %d is not a positive status code", code))
+		}
+	}
+	if cfg.DeltaExpirationAge <= 0 {
+		problems = append(problems, fmt.Sprintf("delta expiration age %s must be positive", cfg.DeltaExpirationAge))
+	}
+	if cfg.DeltaExpirationCheckInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("delta expiration check interval %s must be positive", cfg.DeltaExpirationCheckInterval))
+	}
+	for _, p := range cfg.DistributionPercentiles {
+		if p <= 0 || p > 100 {
+			problems = append(problems, fmt.Sprintf("distribution percentile %g is not between 0 and 100", p))
+		}
+	}
+	if cfg.ViewCardinalityLimit < 0 {
+		problems = append(problems, fmt.Sprintf("view cardinality limit %d must not be negative", cfg.ViewCardinalityLimit))
+	}
+	for i := range cfg.ViewRules {
+		problems = append(problems, cfg.ViewRules[i].validate()...)
+	}
+	if nil != cfg.TailSampling {
+		problems = append(problems, cfg.TailSampling.validate()...)
+	}
+	if nil != cfg.AdaptiveSampling {
+		problems = append(problems, cfg.AdaptiveSampling.validate()...)
+	}
+	if cfg.SpanMetricsInterval < 0 {
+		problems = append(problems, fmt.Sprintf("span metrics interval %s must not be negative", cfg.SpanMetricsInterval))
+	}
+	if nil != cfg.Queue {
+		problems = append(problems, cfg.Queue.validate()...)
+	}
+	if nil != cfg.DiskBuffer {
+		problems = append(problems, cfg.DiskBuffer.validate()...)
+	}
+	if "" != cfg.Region {
+		if _, ok := cfg.Region.Endpoints(); !ok {
+			problems = append(problems, fmt.Sprintf("region %q is not %q, %q, or %q", cfg.Region, RegionUS, RegionEU, RegionFedRAMP))
+		}
+	}
+	if nil != cfg.Endpoints {
+		if !validURL(cfg.Endpoints.SpansURL) {
+			problems = append(problems, fmt.Sprintf("spans URL %q is not an absolute URL", cfg.Endpoints.SpansURL))
+		}
+		if !validURL(cfg.Endpoints.MetricsURL) {
+			problems = append(problems, fmt.Sprintf("metrics URL %q is not an absolute URL", cfg.Endpoints.MetricsURL))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid exporter config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// endpoints returns the endpoints that data is sent to.  The second return
+// value is false if the telemetry.Harvester defaults should be used.
+func (cfg *Config) endpoints(apiKey string) (Endpoints, bool) {
+	if nil != cfg.Endpoints {
+		return *cfg.Endpoints, true
+	}
+	region := cfg.Region
+	if "" == region {
+		var ok bool
+		if region, ok = regionFromAPIKey(apiKey); !ok {
+			return Endpoints{}, false
+		}
+	}
+	return region.Endpoints()
+}
+
+// NewExporterWithOptions creates a new Exporter customized by the options.
+// serviceName is the name of this service or application.  apiKey is
+// required and refers to a New Relic Insights Insert API key.  An error is
+// returned if the resulting Config is invalid.
+func NewExporterWithOptions(serviceName, apiKey string, options ...Option) (*Exporter, error) {
+	cfg := Config{
+		IgnoreStatusCodes:            []int32{5},
+		DeltaExpirationAge:           defaultDeltaExpirationAge,
+		DeltaExpirationCheckInterval: defaultDeltaExpirationCheckInterval,
+	}
+	for _, opt := range options {
+		opt(&cfg)
+	}
+	if err := cfg.validate(); nil != err {
+		return nil, err
+	}
+	if nil == cfg.Resource {
+		res, err := resource.FromEnv(context.Background())
+		if nil != err && nil != cfg.ErrorHandler {
+			cfg.ErrorHandler(err)
+		}
+		cfg.Resource = res
+	}
+
+	telemetryOptions := []func(*telemetry.Config){
+		func(cfg *telemetry.Config) {
+			cfg.Product = userAgentProduct
+			cfg.ProductVersion = version
+		},
+		telemetry.ConfigAPIKey(apiKey),
+	}
+	if ep, ok := cfg.endpoints(apiKey); ok {
+		telemetryOptions = append(telemetryOptions, configEndpoints(ep))
+	}
+	telemetryOptions = append(telemetryOptions, cfg.TelemetryOptions...)
+	var db *diskBuffer
+	if nil != cfg.DiskBuffer {
+		var err error
+		if db, err = newDiskBuffer(*cfg.DiskBuffer, cfg.ErrorHandler); nil != err {
+			return nil, err
+		}
+		telemetryOptions = append(telemetryOptions, db.configTransport())
+	}
+	h, err := telemetry.NewHarvester(telemetryOptions...)
+	if nil != err {
+		return nil, err
+	}
+
+	e := &Exporter{
+		Harvester:         h,
+		ServiceName:       serviceName,
+		IgnoreStatusCodes: cfg.IgnoreStatusCodes,
+		DeltaCalculator: cumulative.NewDeltaCalculator().
+			SetExpirationAge(cfg.DeltaExpirationAge).
+			SetExpirationCheckInterval(cfg.DeltaExpirationCheckInterval),
+		Resource:                  cfg.Resource,
+		ExportDistributionBuckets: cfg.ExportDistributionBuckets,
+		DistributionPercentiles:   cfg.DistributionPercentiles,
+		ExportSpanEvents:          cfg.ExportSpanEvents,
+		CommonAttributes:          cfg.CommonAttributes,
+		AttributeFilter:           cfg.AttributeFilter,
+		ViewCardinalityLimit:      cfg.ViewCardinalityLimit,
+		ViewRules:                 cfg.ViewRules,
+		ConvertUnits:              cfg.ConvertUnits,
+		TailSampling:              cfg.TailSampling,
+		AdaptiveSampling:          cfg.AdaptiveSampling,
+		ExportSpanMetrics:         cfg.ExportSpanMetrics,
+		SpanMetricsInterval:       cfg.SpanMetricsInterval,
+		SpanMetricsNameLimit:      cfg.SpanMetricsNameLimit,
+		Queue:                     cfg.Queue,
+		ErrorHandler:              cfg.ErrorHandler,
+	}
+	if nil != db {
+		db.start()
+		e.diskBuffer = db
+	}
+	e.distributions.expirationAge = cfg.DeltaExpirationAge
+	e.distributions.expirationCheckInterval = cfg.DeltaExpirationCheckInterval
+	e.cardinality.expirationAge = cfg.DeltaExpirationAge
+	e.cardinality.expirationCheckInterval = cfg.DeltaExpirationCheckInterval
+	return e, nil
+}
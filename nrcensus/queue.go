@@ -0,0 +1,235 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// QueuePolicy determines which data is dropped when the Queue is full.
+type QueuePolicy int
+
+// QueuePolicy values.
+const (
+	// DropOldest drops the oldest data in the queue to make room for new
+	// data.
+	DropOldest QueuePolicy = iota
+	// DropNewest drops new data when the queue is full.
+	DropNewest
+)
+
+// Queue configures the Exporter to export data in a background goroutine so
+// that ExportSpan, ExportView, and ExportMetrics never block OpenCensus.
+type Queue struct {
+	// Capacity is the maximum number of spans, view data, and metric
+	// batches waiting to be exported.
+	Capacity int
+	// Policy determines which data is dropped when the queue is full.
+	Policy QueuePolicy
+}
+
+// validate returns the problems with the configuration.
+func (q *Queue) validate() []string {
+	var problems []string
+	if q.Capacity <= 0 {
+		problems = append(problems, fmt.Sprintf("queue capacity %d must be positive", q.Capacity))
+	}
+	if q.Policy != DropOldest && q.Policy != DropNewest {
+		problems = append(problems, fmt.Sprintf("queue policy %d is not DropOldest or DropNewest", q.Policy))
+	}
+	return problems
+}
+
+// queueItem is a unit of work run by the queue worker.  Barriers are used to
+// wait for the work before them and are never dropped.
+type queueItem struct {
+	run     func()
+	barrier bool
+}
+
+// exportQueue runs work in a background goroutine.
+type exportQueue struct {
+	config Queue
+	// count is called with the number of items enqueued and dropped.
+	count func(enqueued, dropped int64)
+
+	lock  sync.Mutex
+	items []queueItem
+	// size is the number of items, excluding barriers, in items.
+	size    int
+	stopped bool
+	// ready has a value when items is not empty.
+	ready chan struct{}
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newExportQueue(config Queue, count func(enqueued, dropped int64)) *exportQueue {
+	return &exportQueue{
+		config: config,
+		count:  count,
+		ready:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// run starts the worker goroutine.
+func (q *exportQueue) run() {
+	go func() {
+		defer close(q.done)
+		for {
+			select {
+			case <-q.ready:
+				q.drain()
+			case <-q.stop:
+				q.drain()
+				return
+			}
+		}
+	}()
+}
+
+// drain runs the items in the queue until it is empty.
+func (q *exportQueue) drain() {
+	for {
+		q.lock.Lock()
+		if 0 == len(q.items) {
+			q.lock.Unlock()
+			return
+		}
+		item := q.items[0]
+		q.items[0] = queueItem{}
+		q.items = q.items[1:]
+		if !item.barrier {
+			q.size--
+		}
+		q.lock.Unlock()
+		item.run()
+	}
+}
+
+// push adds the item to the queue, dropping an item if the queue is full.
+// It returns false if the queue is stopped, in which case the item is dropped.
+func (q *exportQueue) push(item queueItem) bool {
+	var enqueued, dropped int64
+	q.lock.Lock()
+	if q.stopped {
+		q.lock.Unlock()
+		if !item.barrier {
+			q.count(0, 1)
+		}
+		return false
+	}
+	if !item.barrier && q.size >= q.config.Capacity {
+		dropped++
+		if DropNewest == q.config.Policy {
+			q.lock.Unlock()
+			q.count(0, dropped)
+			return true
+		}
+		q.dropOldest()
+	}
+	q.items = append(q.items, item)
+	if !item.barrier {
+		q.size++
+		enqueued++
+	}
+	q.lock.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	if enqueued > 0 || dropped > 0 {
+		q.count(enqueued, dropped)
+	}
+	return true
+}
+
+// dropOldest removes the oldest item which is not a barrier.  q.lock must be
+// held.
+func (q *exportQueue) dropOldest() {
+	for i, item := range q.items {
+		if !item.barrier {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.size--
+			return
+		}
+	}
+}
+
+// flush waits until the work enqueued before it has run or ctx is done.
+func (q *exportQueue) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	if !q.push(queueItem{run: func() { close(done) }, barrier: true}) {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown stops accepting work and waits for the worker to run the work
+// already enqueued.  If ctx is done first the work which has not started is
+// dropped so that the worker exits once the current work has run.
+func (q *exportQueue) shutdown(ctx context.Context) error {
+	q.stopOnce.Do(func() {
+		q.lock.Lock()
+		q.stopped = true
+		q.lock.Unlock()
+		close(q.stop)
+	})
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+	}
+	q.lock.Lock()
+	dropped := int64(q.size)
+	q.items = nil
+	q.size = 0
+	q.lock.Unlock()
+	if dropped > 0 {
+		q.count(0, dropped)
+	}
+	return ctx.Err()
+}
+
+// queue returns the export queue created from Queue, starting it the first
+// time it is called, or nil if Queue is not set.
+func (e *Exporter) queue() *exportQueue {
+	e.queueOnce.Do(func() {
+		if nil == e.Queue {
+			return
+		}
+		e.exportQueue = newExportQueue(*e.Queue, func(enqueued, dropped int64) {
+			e.updateStats(func(s *Stats) {
+				s.Enqueued += enqueued
+				s.QueueDropped += dropped
+			})
+		})
+		e.exportQueue.run()
+	})
+	return e.exportQueue
+}
+
+// enqueue runs fn in the background if Queue is set, returning false if fn
+// must be run by the caller.  fn is dropped if the Queue has been stopped by
+// Shutdown, since the data it exports would miss the final flush.
+func (e *Exporter) enqueue(fn func()) bool {
+	q := e.queue()
+	if nil == q {
+		return false
+	}
+	q.push(queueItem{run: fn})
+	return true
+}
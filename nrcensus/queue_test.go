@@ -0,0 +1,241 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/trace"
+)
+
+func TestExportQueuePolicies(t *testing.T) {
+	for _, policy := range []QueuePolicy{DropOldest, DropNewest} {
+		var lock sync.Mutex
+		var ran []int
+		var enqueued, dropped int64
+		q := newExportQueue(Queue{Capacity: 2, Policy: policy}, func(e, d int64) {
+			enqueued += e
+			dropped += d
+		})
+		// Block the worker so that the queue fills up.
+		block := make(chan struct{})
+		started := make(chan struct{})
+		q.run()
+		q.push(queueItem{run: func() { close(started); <-block }})
+		<-started
+		for i := 0; i < 4; i++ {
+			i := i
+			q.push(queueItem{run: func() {
+				lock.Lock()
+				defer lock.Unlock()
+				ran = append(ran, i)
+			}})
+		}
+		close(block)
+		if err := q.flush(context.Background()); nil != err {
+			t.Fatal(err)
+		}
+		// The item blocking the worker is not counted against the capacity.
+		want, wantEnqueued := []int{2, 3}, int64(5)
+		if DropNewest == policy {
+			want, wantEnqueued = []int{0, 1}, 3
+		}
+		lock.Lock()
+		if !reflect.DeepEqual(ran, want) {
+			t.Errorf("policy %d: incorrect items run: %v", policy, ran)
+		}
+		lock.Unlock()
+		if enqueued != wantEnqueued || dropped != 2 {
+			t.Errorf("policy %d: incorrect counts: enqueued=%d dropped=%d", policy, enqueued, dropped)
+		}
+		q.shutdown(context.Background())
+		if q.push(queueItem{run: func() {}}) {
+			t.Errorf("policy %d: item enqueued after shutdown", policy)
+		}
+		if dropped != 3 {
+			t.Errorf("policy %d: item pushed after shutdown not dropped: %d", policy, dropped)
+		}
+	}
+}
+
+func TestExportQueueFlushContext(t *testing.T) {
+	q := newExportQueue(Queue{Capacity: 1}, func(e, d int64) {})
+	block := make(chan struct{})
+	defer close(block)
+	q.run()
+	q.push(queueItem{run: func() { <-block }})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("incorrect error: %v", err)
+	}
+}
+
+func TestExporterQueue(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:   h,
+		ServiceName: "serviceName",
+		Queue:       &Queue{Capacity: 10},
+	}
+	for i := 0; i < 3; i++ {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: testTraceID,
+			},
+			Name:      "spanName",
+			StartTime: testTime,
+			EndTime:   testTime.Add(time.Second),
+		})
+	}
+	if err := exp.Shutdown(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if len(h.spans) != 3 {
+		t.Errorf("incorrect number of spans recorded: %d", len(h.spans))
+	}
+	if stats := exp.Stats(); stats.Enqueued != 3 || stats.QueueDropped != 0 {
+		t.Errorf("incorrect stats: %#v", stats)
+	}
+}
+
+func TestExporterShutdownContext(t *testing.T) {
+	h := &flushHarvester{}
+	exp := &Exporter{
+		Harvester:         h,
+		ServiceName:       "serviceName",
+		Queue:             &Queue{Capacity: 10},
+		ExportSpanMetrics: true,
+	}
+	// Block the worker so that the queue is not drained.
+	block := make(chan struct{})
+	started := make(chan struct{})
+	exp.enqueue(func() { close(started); <-block })
+	<-started
+	for i := 0; i < 2; i++ {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: testTraceID,
+			},
+			Name:      "spanName",
+			StartTime: testTime,
+			EndTime:   testTime.Add(time.Second),
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := exp.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("incorrect error: %v", err)
+	}
+	// The remaining components are stopped and the final flush still runs.
+	if h.harvests != 1 {
+		t.Errorf("incorrect number of harvests: %d", h.harvests)
+	}
+	select {
+	case <-exp.spanMetrics().done:
+	default:
+		t.Error("span metrics goroutine not stopped")
+	}
+	close(block)
+	<-exp.queue().done
+	if len(h.spans) != 0 {
+		t.Errorf("dropped spans recorded: %d", len(h.spans))
+	}
+	if stats := exp.Stats(); stats.QueueDropped != 2 {
+		t.Errorf("incorrect stats: %#v", stats)
+	}
+}
+
+func TestExporterQueueStopped(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:   h,
+		ServiceName: "serviceName",
+		Queue:       &Queue{Capacity: 10},
+	}
+	// A span exported while Shutdown is running, after the queue stopped,
+	// is dropped rather than exported by the caller.
+	exp.queue().shutdown(context.Background())
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:      "spanName",
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+	})
+	if len(h.spans) != 0 {
+		t.Errorf("span recorded after the queue stopped: %d", len(h.spans))
+	}
+	if stats := exp.Stats(); stats.QueueDropped != 1 {
+		t.Errorf("incorrect stats: %#v", stats)
+	}
+}
+
+func TestExporterShutdownContextHarvests(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if gz, err := gzip.NewReader(r.Body); nil == err {
+			body, _ = ioutil.ReadAll(gz)
+		}
+		lock.Lock()
+		bodies = append(bodies, string(body))
+		lock.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	exp, err := NewExporterWithOptions("serviceName", "apiKey",
+		ConfigQueue(10, DropOldest),
+		ConfigTelemetry(
+			telemetry.ConfigHarvestPeriod(0),
+			telemetry.ConfigSpansURLOverride(srv.URL),
+			func(cfg *telemetry.Config) { cfg.Client = srv.Client() },
+		),
+	)
+	if nil != err {
+		t.Fatal(err)
+	}
+	exp.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			SpanID:  testSpanID,
+			TraceID: testTraceID,
+		},
+		Name:      "recordedSpan",
+		StartTime: testTime,
+		EndTime:   testTime.Add(time.Second),
+	})
+	// Block the worker after the span is recorded so that the queue is not
+	// drained before ctx is done.
+	block := make(chan struct{})
+	started := make(chan struct{})
+	defer close(block)
+	exp.enqueue(func() { close(started); <-block })
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := exp.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("incorrect error: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(bodies) != 1 || !strings.Contains(bodies[0], "recordedSpan") {
+		t.Errorf("recorded span not sent after ctx was done: %q", bodies)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// Region identifies the New Relic data center that data is sent to.
+type Region string
+
+// Region values.
+const (
+	RegionUS      Region = "US"
+	RegionEU      Region = "EU"
+	RegionFedRAMP Region = "FedRAMP"
+)
+
+// Endpoints are the URLs that data is sent to.
+type Endpoints struct {
+	// SpansURL is the URL of the New Relic Trace API.
+	SpansURL string
+	// MetricsURL is the URL of the New Relic Metric API.
+	MetricsURL string
+}
+
+var regionEndpoints = map[Region]Endpoints{
+	RegionUS: {
+		SpansURL:   "https://trace-api.newrelic.com/trace/v1",
+		MetricsURL: "https://metric-api.newrelic.com/metric/v1",
+	},
+	RegionEU: {
+		SpansURL:   "https://trace-api.eu.newrelic.com/trace/v1",
+		MetricsURL: "https://metric-api.eu.newrelic.com/metric/v1",
+	},
+	RegionFedRAMP: {
+		SpansURL:   "https://gov-trace-api.newrelic.com/trace/v1",
+		MetricsURL: "https://gov-metric-api.newrelic.com/metric/v1",
+	},
+}
+
+// Endpoints returns the endpoints of the region.  The second return value is
+// false if the region is unknown.
+func (r Region) Endpoints() (Endpoints, bool) {
+	ep, ok := regionEndpoints[r]
+	return ep, ok
+}
+
+// parseRegion returns the Region with the given case-insensitive name.
+func parseRegion(name string) (Region, bool) {
+	for r := range regionEndpoints {
+		if strings.EqualFold(string(r), name) {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+// euKeyPattern matches the prefix of the keys of EU accounts, eg. "eu01xx".
+var euKeyPattern = regexp.MustCompile(`^eu\d{2}xx`)
+
+// regionFromAPIKey returns the region of the account the key belongs to when
+// the key identifies it.  Only EU keys have a region prefix, so the second
+// return value is false for all other keys.
+func regionFromAPIKey(apiKey string) (Region, bool) {
+	if euKeyPattern.MatchString(apiKey) {
+		return RegionEU, true
+	}
+	return "", false
+}
+
+// configEndpoints returns a telemetry option which sends data to ep.
+func configEndpoints(ep Endpoints) func(*telemetry.Config) {
+	return func(cfg *telemetry.Config) {
+		cfg.SpansURLOverride = ep.SpansURL
+		cfg.MetricsURLOverride = ep.MetricsURL
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"go.opencensus.io/resource"
+)
+
+// resourceAttrLen returns the number of attributes added by
+// addResourceAttributes for r.
+func resourceAttrLen(r *resource.Resource) int {
+	if nil == r {
+		return 0
+	}
+	if "" == r.Type {
+		return len(r.Labels)
+	}
+	return len(r.Labels) + 1
+}
+
+// addResourceAttributes adds the labels of r, and its type as the
+// "resource.type" attribute, to attrs.  Resource attributes have the lowest
+// precedence so attributes already in attrs are not overwritten.
+func addResourceAttributes(attrs map[string]interface{}, r *resource.Resource) {
+	if nil == r {
+		return
+	}
+	for k, v := range r.Labels {
+		if _, in := attrs[k]; !in {
+			attrs[k] = v
+		}
+	}
+	if "" != r.Type {
+		if _, in := attrs["resource.type"]; !in {
+			attrs["resource.type"] = r.Type
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/trace"
+)
+
+// Values of the "span.event.type" attribute.
+const (
+	spanEventTypeAnnotation = "annotation"
+	spanEventTypeMessage    = "message"
+	spanEventTypeLink       = "link"
+)
+
+// spanEventID creates a span ID for the i-th event of the span with the given
+// ID.  The ID is derived from the parent so that exporting the same SpanData
+// twice produces the same IDs.
+func spanEventID(parent trace.SpanID, i int) string {
+	h := fnv.New64a()
+	h.Write(parent[:])
+	var idx [8]byte
+	binary.BigEndian.PutUint64(idx[:], uint64(i))
+	h.Write(idx[:])
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func messageEventName(t trace.MessageEventType) string {
+	switch t {
+	case trace.MessageEventTypeSent:
+		return "message.sent"
+	case trace.MessageEventTypeRecv:
+		return "message.received"
+	default:
+		return "message"
+	}
+}
+
+func linkTypeName(t trace.LinkType) string {
+	switch t {
+	case trace.LinkTypeChild:
+		return "child"
+	case trace.LinkTypeParent:
+		return "parent"
+	default:
+		return "unspecified"
+	}
+}
+
+// spanEvents creates the spans used to represent the annotations, message
+// events, and links of s.  The New Relic Trace API does not support events
+// within a span, so each event becomes a zero duration child of the span sp
+// created from s.  Links are recorded at the start of the span.  Annotations
+// without a message are named "annotation".
+func (e *Exporter) spanEvents(s *trace.SpanData, sp telemetry.Span) []telemetry.Span {
+	n := len(s.Annotations) + len(s.MessageEvents) + len(s.Links)
+	if 0 == n {
+		return nil
+	}
+	events := make([]telemetry.Span, 0, n)
+	newEvent := func(name string, attrs map[string]interface{}) telemetry.Span {
+		attrs["instrumentation.provider"] = instrumentationProvider
+		attrs["collector.name"] = collectorName
+		addCommonAttributes(attrs, e.CommonAttributes)
+		addResourceAttributes(attrs, e.Resource)
+		return telemetry.Span{
+			ID:          spanEventID(s.SpanContext.SpanID, len(events)),
+			TraceID:     sp.TraceID,
+			ParentID:    sp.ID,
+			Name:        name,
+			ServiceName: sp.ServiceName,
+			Attributes:  attrs,
+		}
+	}
+
+	for _, a := range s.Annotations {
+		attrs := make(map[string]interface{}, len(a.Attributes)+3)
+		for k, v := range a.Attributes {
+			attrs[k] = v
+		}
+		e.AttributeFilter.apply(attrs)
+		attrs["span.event.type"] = spanEventTypeAnnotation
+		name := a.Message
+		if "" == name {
+			name = spanEventTypeAnnotation
+		}
+		ev := newEvent(name, attrs)
+		ev.Timestamp = a.Time
+		events = append(events, ev)
+	}
+	for _, m := range s.MessageEvents {
+		ev := newEvent(messageEventName(m.EventType), map[string]interface{}{
+			"span.event.type":           spanEventTypeMessage,
+			"message.id":                m.MessageID,
+			"message.size.uncompressed": m.UncompressedByteSize,
+			"message.size.compressed":   m.CompressedByteSize,
+		})
+		ev.Timestamp = m.Time
+		events = append(events, ev)
+	}
+	for _, l := range s.Links {
+		attrs := make(map[string]interface{}, len(l.Attributes)+6)
+		for k, v := range l.Attributes {
+			attrs[k] = v
+		}
+		e.AttributeFilter.apply(attrs)
+		attrs["span.event.type"] = spanEventTypeLink
+		attrs["link.trace.id"] = l.TraceID.String()
+		attrs["link.span.id"] = l.SpanID.String()
+		attrs["link.type"] = linkTypeName(l.Type)
+		ev := newEvent("link", attrs)
+		ev.Timestamp = s.StartTime
+		events = append(events, ev)
+	}
+	return events
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+const (
+	// defaultSpanMetricsInterval is used when Exporter.SpanMetricsInterval
+	// is not positive.  It matches the default harvest period of the
+	// telemetry.Harvester.
+	defaultSpanMetricsInterval = 5 * time.Second
+	// defaultSpanMetricsNameLimit is used when Exporter.SpanMetricsNameLimit
+	// is zero.
+	defaultSpanMetricsNameLimit = 1000
+)
+
+// Names of the metrics recorded when Exporter.ExportSpanMetrics is enabled.
+const (
+	spanCountMetricName    = "span.count"
+	spanDurationMetricName = "span.duration"
+)
+
+// spanMetricsKey identifies the spans aggregated together.
+type spanMetricsKey struct {
+	name  string
+	kind  string
+	isErr bool
+}
+
+// spanMetricsValue aggregates the durations of spans in seconds.
+type spanMetricsValue struct {
+	count float64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// spanMetrics aggregates the spans exported during each interval into
+// metrics.
+type spanMetrics struct {
+	interval time.Duration
+	// nameLimit, if positive, is the maximum number of distinct span names
+	// aggregated.
+	nameLimit int
+	// record is called with the metrics at the end of each interval.
+	record func(telemetry.Metric)
+	// attributes returns the attributes of the metrics for the key.
+	attributes func(spanMetricsKey) map[string]interface{}
+	// now returns the current time.  It is replaced by tests.
+	now func() time.Time
+
+	lock   sync.Mutex
+	start  time.Time
+	values map[spanMetricsKey]*spanMetricsValue
+	// names holds the span names seen, up to nameLimit.
+	names map[string]struct{}
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newSpanMetrics(interval time.Duration, nameLimit int, record func(telemetry.Metric), attributes func(spanMetricsKey) map[string]interface{}) *spanMetrics {
+	if interval <= 0 {
+		interval = defaultSpanMetricsInterval
+	}
+	if 0 == nameLimit {
+		nameLimit = defaultSpanMetricsNameLimit
+	}
+	sm := &spanMetrics{
+		interval:   interval,
+		nameLimit:  nameLimit,
+		record:     record,
+		attributes: attributes,
+		now:        time.Now,
+		values:     make(map[spanMetricsKey]*spanMetricsValue),
+		names:      make(map[string]struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	sm.start = sm.now()
+	return sm
+}
+
+// run records the metrics every interval in the background until shutdown is
+// called.
+func (sm *spanMetrics) run() {
+	go func() {
+		defer close(sm.done)
+		ticker := time.NewTicker(sm.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sm.flush()
+			case <-sm.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops the background goroutine started by run and records the
+// remaining metrics.
+func (sm *spanMetrics) shutdown() {
+	sm.stopOnce.Do(func() {
+		close(sm.stop)
+		<-sm.done
+	})
+	sm.flush()
+}
+
+// add aggregates the span.  Spans whose names are first seen after nameLimit
+// names have been seen are aggregated with the name "other".
+func (sm *spanMetrics) add(key spanMetricsKey, duration time.Duration) {
+	seconds := duration.Seconds()
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	if sm.nameLimit > 0 {
+		if _, ok := sm.names[key.name]; !ok {
+			if len(sm.names) >= sm.nameLimit {
+				key.name = overflowTagValue
+			} else {
+				sm.names[key.name] = struct{}{}
+			}
+		}
+	}
+
+	v, ok := sm.values[key]
+	if !ok {
+		sm.values[key] = &spanMetricsValue{count: 1, sum: seconds, min: seconds, max: seconds}
+		return
+	}
+	v.count++
+	v.sum += seconds
+	if seconds < v.min {
+		v.min = seconds
+	}
+	if seconds > v.max {
+		v.max = seconds
+	}
+}
+
+// flush records the metrics for the spans aggregated since the previous
+// flush.
+func (sm *spanMetrics) flush() {
+	now := sm.now()
+	sm.lock.Lock()
+	values, start := sm.values, sm.start
+	sm.values = make(map[spanMetricsKey]*spanMetricsValue)
+	sm.start = now
+	sm.lock.Unlock()
+
+	interval := now.Sub(start)
+	for key, v := range values {
+		attrs := sm.attributes(key)
+		sm.record(telemetry.Count{
+			Name:       spanCountMetricName,
+			Attributes: attrs,
+			Value:      v.count,
+			Timestamp:  start,
+			Interval:   interval,
+		})
+		sm.record(telemetry.Summary{
+			Name:       spanDurationMetricName,
+			Attributes: attrs,
+			Count:      v.count,
+			Sum:        v.sum,
+			Min:        v.min,
+			Max:        v.max,
+			Timestamp:  start,
+			Interval:   interval,
+		})
+	}
+}
+
+// spanMetricsAttributes returns the attributes of the span metrics for key.
+func (e *Exporter) spanMetricsAttributes(key spanMetricsKey) map[string]interface{} {
+	attrs := make(map[string]interface{}, 7+len(e.CommonAttributes)+resourceAttrLen(e.Resource))
+	attrs["span.name"] = key.name
+	if "" != key.kind {
+		attrs["span.kind"] = key.kind
+	}
+	attrs["error"] = key.isErr
+	attrs["service.name"] = e.ServiceName
+	attrs["measure.unit"] = unitSeconds
+	attrs["instrumentation.provider"] = instrumentationProvider
+	attrs["collector.name"] = collectorName
+	addCommonAttributes(attrs, e.CommonAttributes)
+	addResourceAttributes(attrs, e.Resource)
+	return attrs
+}
+
+// spanMetrics returns the span metrics aggregator, starting it the first
+// time it is called, or nil if ExportSpanMetrics is not enabled.
+func (e *Exporter) spanMetrics() *spanMetrics {
+	e.spanMetricsOnce.Do(func() {
+		if !e.ExportSpanMetrics {
+			return
+		}
+		e.spanMetricsAggregator = newSpanMetrics(e.SpanMetricsInterval, e.SpanMetricsNameLimit, e.recordMetric, e.spanMetricsAttributes)
+		e.spanMetricsAggregator.run()
+	})
+	return e.spanMetricsAggregator
+}
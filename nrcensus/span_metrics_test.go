@@ -0,0 +1,137 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/trace"
+)
+
+func TestSpanMetrics(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:         h,
+		ServiceName:       "serviceName",
+		IgnoreStatusCodes: []int32{5},
+		ExportSpanMetrics: true,
+		// Metrics are only recorded by Flush in this test.
+		SpanMetricsInterval: time.Hour,
+		// Span metrics are derived before sampling.
+		TailSampling: &TailSampling{Window: time.Hour},
+	}
+	sm := exp.spanMetrics()
+	now := testTime
+	sm.now = func() time.Time { return now }
+	sm.start = now
+
+	export := func(name string, kind int, code int32, duration time.Duration) {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: testTraceID,
+			},
+			Name:      name,
+			SpanKind:  kind,
+			StartTime: testTime,
+			EndTime:   testTime.Add(duration),
+			Status:    trace.Status{Code: code},
+		})
+	}
+	export("GET /", trace.SpanKindServer, 0, time.Second)
+	export("GET /", trace.SpanKindServer, 5, 3*time.Second)
+	export("GET /", trace.SpanKindServer, 2, 2*time.Second)
+	now = now.Add(10 * time.Second)
+	if err := exp.Flush(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	exp.Shutdown(context.Background())
+
+	if len(h.spans) != 0 {
+		t.Errorf("sampled spans recorded: %d", len(h.spans))
+	}
+	okAttrs := map[string]interface{}{
+		"span.name":                "GET /",
+		"span.kind":                "server",
+		"error":                    false,
+		"service.name":             "serviceName",
+		"measure.unit":             "s",
+		"instrumentation.provider": instrumentationProvider,
+		"collector.name":           collectorName,
+	}
+	errAttrs := make(map[string]interface{}, len(okAttrs))
+	for k, v := range okAttrs {
+		errAttrs[k] = v
+	}
+	errAttrs["error"] = true
+
+	var ok, failed []telemetry.Metric
+	for _, m := range h.metrics {
+		var attrs map[string]interface{}
+		switch metric := m.(type) {
+		case telemetry.Count:
+			attrs = metric.Attributes
+		case telemetry.Summary:
+			attrs = metric.Attributes
+		}
+		if attrs["error"] == true {
+			failed = append(failed, m)
+		} else {
+			ok = append(ok, m)
+		}
+	}
+	if !reflect.DeepEqual(ok, []telemetry.Metric{
+		telemetry.Count{Name: "span.count", Attributes: okAttrs, Value: 2, Timestamp: testTime, Interval: 10 * time.Second},
+		telemetry.Summary{Name: "span.duration", Attributes: okAttrs, Count: 2, Sum: 4, Min: 1, Max: 3, Timestamp: testTime, Interval: 10 * time.Second},
+	}) {
+		t.Errorf("incorrect metrics: %#v", ok)
+	}
+	if !reflect.DeepEqual(failed, []telemetry.Metric{
+		telemetry.Count{Name: "span.count", Attributes: errAttrs, Value: 1, Timestamp: testTime, Interval: 10 * time.Second},
+		telemetry.Summary{Name: "span.duration", Attributes: errAttrs, Count: 1, Sum: 2, Min: 2, Max: 2, Timestamp: testTime, Interval: 10 * time.Second},
+	}) {
+		t.Errorf("incorrect error metrics: %#v", failed)
+	}
+}
+
+func TestSpanMetricsNameLimit(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:            h,
+		ExportSpanMetrics:    true,
+		SpanMetricsInterval:  -time.Second,
+		SpanMetricsNameLimit: 2,
+	}
+	for _, name := range []string{"/a", "/b", "/c", "/a", "/d"} {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: testTraceID,
+			},
+			Name:      name,
+			StartTime: testTime,
+			EndTime:   testTime.Add(time.Second),
+		})
+	}
+	if err := exp.Shutdown(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if interval := exp.spanMetrics().interval; interval != defaultSpanMetricsInterval {
+		t.Errorf("negative interval not defaulted: %s", interval)
+	}
+
+	counts := make(map[interface{}]float64)
+	for _, m := range h.metrics {
+		if c, ok := m.(telemetry.Count); ok && c.Name == spanCountMetricName {
+			counts[c.Attributes["span.name"]] += c.Value
+		}
+	}
+	if want := map[interface{}]float64{"/a": 2, "/b": 1, "other": 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("incorrect span counts: %v", counts)
+	}
+}
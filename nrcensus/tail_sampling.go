@@ -0,0 +1,325 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+const (
+	// defaultTailSamplingWindow is used when TailSampling.Window is not
+	// positive.
+	defaultTailSamplingWindow = 10 * time.Second
+	// defaultTailSamplingMaxTraces is used when TailSampling.MaxTraces is
+	// not positive.
+	defaultTailSamplingMaxTraces = 10000
+)
+
+// TailSampling configures the Exporter to buffer the spans of each trace and
+// decide whether to keep the whole trace once it is complete.  A trace is
+// kept if any of its spans matches one of the policies, and otherwise with
+// probability BaseRate.  Spans which arrive after the decision for their
+// trace was made follow that decision.
+type TailSampling struct {
+	// Window is how long the spans of a trace are buffered after its first
+	// span is exported before the decision is made.  By default, Window is
+	// 10 seconds.
+	Window time.Duration
+	// MaxTraces is the maximum number of traces buffered.  When it is
+	// reached the decision for the oldest trace is made early.  By default,
+	// MaxTraces is 10000.
+	MaxTraces int
+	// KeepErrors keeps traces which have an error span, as determined by
+	// IgnoreStatusCodes or the "error" attribute.
+	KeepErrors bool
+	// MinDuration, if positive, keeps traces which have a span at least
+	// this long.
+	MinDuration time.Duration
+	// KeepAttributes keeps traces which have a span with an attribute whose
+	// key is in the map and whose value, formatted with fmt.Sprint, matches
+	// the Matcher.
+	KeepAttributes map[string]Matcher
+	// BaseRate is the probability, between 0 and 1, of keeping traces which
+	// do not match any of the policies.  The decision is made by hashing the
+	// trace ID so that it is consistent across services.  The spans of
+	// traces kept by BaseRate have a "sampling.rate" attribute.
+	BaseRate float64
+}
+
+// validate returns the problems with the configuration.
+func (ts *TailSampling) validate() []string {
+	var problems []string
+	if ts.Window < 0 {
+		problems = append(problems, fmt.Sprintf("tail sampling window %s must not be negative", ts.Window))
+	}
+	if ts.MaxTraces < 0 {
+		problems = append(problems, fmt.Sprintf("tail sampling max traces %d must not be negative", ts.MaxTraces))
+	}
+	if ts.BaseRate < 0 || ts.BaseRate > 1 {
+		problems = append(problems, fmt.Sprintf("tail sampling base rate %g is not between 0 and 1", ts.BaseRate))
+	}
+	for k, m := range ts.KeepAttributes {
+		if nil == m {
+			problems = append(problems, fmt.Sprintf("tail sampling attribute %q has no Matcher", k))
+		}
+	}
+	return problems
+}
+
+// keepSpan returns true if the span matches one of the policies.
+func (ts *TailSampling) keepSpan(sp telemetry.Span, isErr bool) bool {
+	if ts.KeepErrors && isErr {
+		return true
+	}
+	if ts.MinDuration > 0 && sp.Duration >= ts.MinDuration {
+		return true
+	}
+	for k, m := range ts.KeepAttributes {
+		if v, in := sp.Attributes[k]; in && nil != m && m.MatchString(fmt.Sprint(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// traceIDRatio maps the trace ID to a number in [0, 1) so that probability
+// sampling decisions are consistent for all spans of a trace.
+func traceIDRatio(traceID string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(traceID))
+	// FNV does not spread similar inputs over the high bits, so mix the
+	// hash with the splitmix64 finalizer.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
+
+// bufferedTrace holds the spans of a trace until the sampling decision.
+type bufferedTrace struct {
+	first time.Time
+	spans []telemetry.Span
+	keep  bool
+}
+
+// tailDecision is the sampling decision for a trace.  rate is the
+// probability that the trace was kept: 1 if it matched a policy, otherwise
+// BaseRate.
+type tailDecision struct {
+	keep bool
+	rate float64
+	when time.Time
+}
+
+// tailKept holds the spans of a kept trace.
+type tailKept struct {
+	spans []telemetry.Span
+	rate  float64
+}
+
+// tailDecisions accumulates the results of decisions made while holding the
+// lock so that the kept spans can be recorded after it is released.
+type tailDecisions struct {
+	kept    []tailKept
+	keep    int64
+	dropped int64
+}
+
+// tailSampler buffers spans by trace ID for TailSampling.
+type tailSampler struct {
+	config TailSampling
+	// record is called with the spans of kept traces and the probability
+	// that the trace was kept.
+	record func(sp telemetry.Span, rate float64)
+	// now returns the current time.  It is replaced by tests.
+	now func() time.Time
+	// count is called with the number of traces kept and dropped.
+	count func(kept, dropped int64)
+
+	lock    sync.Mutex
+	traces  map[string]*bufferedTrace
+	order   []string
+	decided map[string]tailDecision
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newTailSampler(config TailSampling, record func(telemetry.Span, float64), count func(kept, dropped int64)) *tailSampler {
+	if config.Window <= 0 {
+		config.Window = defaultTailSamplingWindow
+	}
+	if config.MaxTraces <= 0 {
+		config.MaxTraces = defaultTailSamplingMaxTraces
+	}
+	return &tailSampler{
+		config:  config,
+		record:  record,
+		now:     time.Now,
+		count:   count,
+		traces:  make(map[string]*bufferedTrace),
+		decided: make(map[string]tailDecision),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// start makes decisions for the traces whose window has passed in the
+// background until shutdown is called.
+func (ts *tailSampler) start() {
+	go func() {
+		defer close(ts.done)
+		interval := ts.config.Window / 2
+		if interval <= 0 {
+			interval = ts.config.Window
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ts.expire()
+			case <-ts.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops the background goroutine started by start and makes
+// decisions for all buffered traces.
+func (ts *tailSampler) shutdown() {
+	ts.stopOnce.Do(func() {
+		close(ts.stop)
+		<-ts.done
+	})
+	ts.flush()
+}
+
+// add buffers the spans, which belong to the same trace, until the decision
+// for the trace is made.  isErr is true if the span which the spans were
+// created from is an error.
+func (ts *tailSampler) add(spans []telemetry.Span, isErr bool) {
+	if 0 == len(spans) {
+		return
+	}
+	traceID := spans[0].TraceID
+	var keep bool
+	for _, sp := range spans {
+		if ts.config.keepSpan(sp, isErr) {
+			keep = true
+			break
+		}
+	}
+
+	var ds tailDecisions
+	ts.lock.Lock()
+	if d, ok := ts.decided[traceID]; ok {
+		ts.lock.Unlock()
+		if d.keep {
+			ts.recordAll(spans, d.rate)
+		}
+		return
+	}
+	t, ok := ts.traces[traceID]
+	if !ok {
+		now := ts.now()
+		for len(ts.traces) >= ts.config.MaxTraces && len(ts.order) > 0 {
+			ts.decideLocked(ts.order[0], now, &ds)
+			ts.order = ts.order[1:]
+		}
+		t = &bufferedTrace{first: now}
+		ts.traces[traceID] = t
+		ts.order = append(ts.order, traceID)
+	}
+	t.spans = append(t.spans, spans...)
+	t.keep = t.keep || keep
+	ts.lock.Unlock()
+
+	ts.finish(ds)
+}
+
+// decideLocked makes the decision for the trace if it is buffered, adding
+// the result to ds.  ts.lock must be held.
+func (ts *tailSampler) decideLocked(traceID string, now time.Time, ds *tailDecisions) {
+	t, ok := ts.traces[traceID]
+	if !ok {
+		return
+	}
+	delete(ts.traces, traceID)
+	keep, rate := t.keep, 1.0
+	if !keep {
+		keep, rate = traceIDRatio(traceID) < ts.config.BaseRate, ts.config.BaseRate
+	}
+	ts.decided[traceID] = tailDecision{keep: keep, rate: rate, when: now}
+	if !keep {
+		ds.dropped++
+		return
+	}
+	ds.keep++
+	ds.kept = append(ds.kept, tailKept{spans: t.spans, rate: rate})
+}
+
+// expire makes decisions for the traces whose window has passed and forgets
+// decisions which were made more than a window ago.
+func (ts *tailSampler) expire() {
+	var ds tailDecisions
+	now := ts.now()
+	ts.lock.Lock()
+	for len(ts.order) > 0 {
+		traceID := ts.order[0]
+		if t, ok := ts.traces[traceID]; ok && now.Sub(t.first) < ts.config.Window {
+			break
+		}
+		ts.decideLocked(traceID, now, &ds)
+		ts.order = ts.order[1:]
+	}
+	for traceID, d := range ts.decided {
+		if now.Sub(d.when) >= ts.config.Window {
+			delete(ts.decided, traceID)
+		}
+	}
+	ts.lock.Unlock()
+
+	ts.finish(ds)
+}
+
+// flush makes decisions for all buffered traces.
+func (ts *tailSampler) flush() {
+	var ds tailDecisions
+	now := ts.now()
+	ts.lock.Lock()
+	for _, traceID := range ts.order {
+		ts.decideLocked(traceID, now, &ds)
+	}
+	ts.order = nil
+	ts.lock.Unlock()
+
+	ts.finish(ds)
+}
+
+// finish records the spans of kept traces and counts the decisions.
+func (ts *tailSampler) finish(ds tailDecisions) {
+	for _, k := range ds.kept {
+		ts.recordAll(k.spans, k.rate)
+	}
+	if (ds.keep > 0 || ds.dropped > 0) && nil != ts.count {
+		ts.count(ds.keep, ds.dropped)
+	}
+}
+
+func (ts *tailSampler) recordAll(spans []telemetry.Span, rate float64) {
+	for _, sp := range spans {
+		ts.record(sp, rate)
+	}
+}
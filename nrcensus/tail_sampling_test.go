@@ -0,0 +1,172 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.opencensus.io/trace"
+)
+
+// testTailSampler returns a tail sampler whose clock is controlled by the
+// returned function and a pointer to the names of the spans it records.
+func testTailSampler(config TailSampling) (*tailSampler, func(time.Duration), *[]string) {
+	var recorded []string
+	ts := newTailSampler(config, func(sp telemetry.Span, rate float64) {
+		recorded = append(recorded, sp.Name)
+	}, nil)
+	now := testTime
+	ts.now = func() time.Time { return now }
+	return ts, func(d time.Duration) { now = now.Add(d) }, &recorded
+}
+
+func testTraceSpan(traceID, name string, duration time.Duration, attrs map[string]interface{}) telemetry.Span {
+	return telemetry.Span{TraceID: traceID, Name: name, Duration: duration, Attributes: attrs}
+}
+
+func TestTailSamplerPolicies(t *testing.T) {
+	ts, advance, recorded := testTailSampler(TailSampling{
+		Window:         time.Minute,
+		KeepErrors:     true,
+		MinDuration:    time.Second,
+		KeepAttributes: map[string]Matcher{"http.status_code": regexp.MustCompile(`^5`)},
+	})
+	ts.add([]telemetry.Span{testTraceSpan("error", "error1", 0, nil)}, false)
+	ts.add([]telemetry.Span{testTraceSpan("error", "error2", 0, nil)}, true)
+	ts.add([]telemetry.Span{testTraceSpan("slow", "slow", 2*time.Second, nil)}, false)
+	ts.add([]telemetry.Span{testTraceSpan("attr", "attr", 0, map[string]interface{}{"http.status_code": 503})}, false)
+	ts.add([]telemetry.Span{testTraceSpan("boring", "boring", 0, map[string]interface{}{"http.status_code": 200})}, false)
+
+	ts.expire()
+	if len(*recorded) != 0 {
+		t.Fatalf("spans recorded before the window passed: %v", *recorded)
+	}
+	advance(time.Minute)
+	ts.expire()
+	if !reflect.DeepEqual(*recorded, []string{"error1", "error2", "slow", "attr"}) {
+		t.Errorf("incorrect spans recorded: %v", *recorded)
+	}
+
+	// Late spans follow the decision for their trace.
+	ts.add([]telemetry.Span{testTraceSpan("error", "late", 0, nil)}, false)
+	ts.add([]telemetry.Span{testTraceSpan("boring", "late boring", 0, nil)}, false)
+	if !reflect.DeepEqual(*recorded, []string{"error1", "error2", "slow", "attr", "late"}) {
+		t.Errorf("incorrect spans recorded: %v", *recorded)
+	}
+
+	// Decisions are forgotten after another window.
+	advance(time.Minute)
+	ts.expire()
+	if len(ts.decided) != 0 || len(ts.traces) != 0 || len(ts.order) != 0 {
+		t.Errorf("sampler state not cleaned: %d %d %d", len(ts.decided), len(ts.traces), len(ts.order))
+	}
+}
+
+func TestTailSamplerBaseRate(t *testing.T) {
+	for _, rate := range []float64{0, 1} {
+		ts, _, recorded := testTailSampler(TailSampling{Window: time.Minute, BaseRate: rate})
+		for i := 0; i < 100; i++ {
+			ts.add([]telemetry.Span{testTraceSpan(fmt.Sprint(i), "span", 0, nil)}, false)
+		}
+		ts.flush()
+		if want := int(rate * 100); len(*recorded) != want {
+			t.Errorf("rate %g: %d spans recorded, want %d", rate, len(*recorded), want)
+		}
+	}
+
+	ts, _, recorded := testTailSampler(TailSampling{Window: time.Minute, BaseRate: 0.5})
+	for i := 0; i < 1000; i++ {
+		ts.add([]telemetry.Span{testTraceSpan(fmt.Sprint(i), "span", 0, nil)}, false)
+	}
+	ts.flush()
+	if n := len(*recorded); n < 400 || n > 600 {
+		t.Errorf("%d of 1000 traces kept at rate 0.5", n)
+	}
+}
+
+func TestTailSamplerMaxTraces(t *testing.T) {
+	ts, _, recorded := testTailSampler(TailSampling{Window: time.Minute, MaxTraces: 2, KeepErrors: true})
+	ts.add([]telemetry.Span{testTraceSpan("a", "a", 0, nil)}, true)
+	ts.add([]telemetry.Span{testTraceSpan("b", "b", 0, nil)}, true)
+	ts.add([]telemetry.Span{testTraceSpan("c", "c", 0, nil)}, true)
+	if !reflect.DeepEqual(*recorded, []string{"a"}) {
+		t.Errorf("oldest trace not decided early: %v", *recorded)
+	}
+	if len(ts.traces) != 2 {
+		t.Errorf("incorrect number of buffered traces: %d", len(ts.traces))
+	}
+}
+
+func TestExporterTailSampling(t *testing.T) {
+	h := &testHarvester{}
+	exp := &Exporter{
+		Harvester:         h,
+		ServiceName:       "serviceName",
+		IgnoreStatusCodes: []int32{5},
+		ExportSpanEvents:  true,
+		TailSampling:      &TailSampling{Window: time.Hour, KeepErrors: true},
+	}
+	export := func(traceID byte, code int32) {
+		exp.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				SpanID:  testSpanID,
+				TraceID: trace.TraceID{traceID},
+			},
+			Name:        "spanName",
+			StartTime:   testTime,
+			EndTime:     testTime.Add(time.Second),
+			Status:      trace.Status{Code: code},
+			Annotations: []trace.Annotation{{Time: testTime, Message: "annotation"}},
+		})
+	}
+	export(1, 0)
+	export(1, 2)
+	export(2, 5)
+	if len(h.spans) != 0 {
+		t.Fatalf("spans recorded before the decision: %d", len(h.spans))
+	}
+	if err := exp.Shutdown(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	// Both spans of the error trace and their annotations are kept.
+	if len(h.spans) != 4 {
+		t.Errorf("incorrect number of spans recorded: %d", len(h.spans))
+	}
+	for _, sp := range h.spans {
+		if sp.TraceID != (trace.TraceID{1}).String() {
+			t.Errorf("span of dropped trace recorded: %#v", sp)
+		}
+	}
+	if stats := exp.Stats(); stats.TracesKept != 1 || stats.TracesDropped != 1 {
+		t.Errorf("incorrect stats: %#v", stats)
+	}
+}
+
+func TestExporterTailSamplingDefaults(t *testing.T) {
+	for _, window := range []time.Duration{0, 1, -time.Second} {
+		exp := &Exporter{
+			Harvester:    &testHarvester{},
+			TailSampling: &TailSampling{Window: window, MaxTraces: -1},
+		}
+		ts := exp.sampler()
+		if window > 0 && ts.config.Window != window {
+			t.Errorf("window %s changed to %s", window, ts.config.Window)
+		}
+		if window <= 0 && ts.config.Window != defaultTailSamplingWindow {
+			t.Errorf("window %s not defaulted: %s", window, ts.config.Window)
+		}
+		if ts.config.MaxTraces != defaultTailSamplingMaxTraces {
+			t.Errorf("max traces not defaulted: %d", ts.config.MaxTraces)
+		}
+		if err := exp.Shutdown(context.Background()); nil != err {
+			t.Error(err)
+		}
+	}
+}
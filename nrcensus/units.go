@@ -0,0 +1,94 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"go.opencensus.io/stats/view"
+)
+
+// Canonical units that values are converted to when Exporter.ConvertUnits is
+// enabled.
+const (
+	unitSeconds = "s"
+	unitBytes   = "By"
+)
+
+// unitConversion converts values to a canonical unit by multiplying them by
+// factor.
+type unitConversion struct {
+	unit   string
+	factor float64
+}
+
+// unitConversions maps UCUM units (http://unitsofmeasure.org/ucum.html) of time
+// and information to their canonical units.
+var unitConversions = map[string]unitConversion{
+	"ns":   {unit: unitSeconds, factor: 1e-9},
+	"us":   {unit: unitSeconds, factor: 1e-6},
+	"ms":   {unit: unitSeconds, factor: 1e-3},
+	"min":  {unit: unitSeconds, factor: 60},
+	"h":    {unit: unitSeconds, factor: 60 * 60},
+	"d":    {unit: unitSeconds, factor: 24 * 60 * 60},
+	"bit":  {unit: unitBytes, factor: 1.0 / 8},
+	"kBy":  {unit: unitBytes, factor: 1e3},
+	"MBy":  {unit: unitBytes, factor: 1e6},
+	"GBy":  {unit: unitBytes, factor: 1e9},
+	"KiBy": {unit: unitBytes, factor: 1 << 10},
+	"MiBy": {unit: unitBytes, factor: 1 << 20},
+	"GiBy": {unit: unitBytes, factor: 1 << 30},
+}
+
+// convertUnits returns the view data with the values converted to the
+// canonical unit of the unit of the measure of the view if ConvertUnits is
+// enabled.  Count views are not converted since their values are counts
+// rather than measurements.  vd is not modified.
+func (e *Exporter) convertUnits(vd *view.Data) *view.Data {
+	if !e.ConvertUnits {
+		return vd
+	}
+	if nil == vd.View.Aggregation || view.AggTypeCount == vd.View.Aggregation.Type {
+		return vd
+	}
+	conv, ok := unitConversions[vd.View.Measure.Unit()]
+	if !ok {
+		return vd
+	}
+
+	v := *vd.View
+	v.Measure = unitMeasure{Measure: v.Measure, unit: conv.unit}
+	if len(v.Aggregation.Buckets) > 0 {
+		agg := *v.Aggregation
+		agg.Buckets = make([]float64, len(v.Aggregation.Buckets))
+		for i, b := range v.Aggregation.Buckets {
+			agg.Buckets[i] = b * conv.factor
+		}
+		v.Aggregation = &agg
+	}
+	rows := make([]*view.Row, len(vd.Rows))
+	for i, row := range vd.Rows {
+		rows[i] = &view.Row{Tags: row.Tags, Data: scaleAggregationData(row.Data, conv.factor)}
+	}
+	return &view.Data{View: &v, Start: vd.Start, End: vd.End, Rows: rows}
+}
+
+// scaleAggregationData returns a copy of data with the values multiplied by
+// factor.
+func scaleAggregationData(data view.AggregationData, factor float64) view.AggregationData {
+	switch d := data.(type) {
+	case *view.SumData:
+		return &view.SumData{Value: d.Value * factor}
+	case *view.LastValueData:
+		return &view.LastValueData{Value: d.Value * factor}
+	case *view.DistributionData:
+		return &view.DistributionData{
+			Count:           d.Count,
+			Min:             d.Min * factor,
+			Max:             d.Max * factor,
+			Mean:            d.Mean * factor,
+			SumOfSquaredDev: d.SumOfSquaredDev * factor * factor,
+			CountPerBucket:  d.CountPerBucket,
+		}
+	}
+	return data
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package nrcensus
+
+import (
+	"fmt"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// ViewRule customizes how the views it matches are exported, eg. to make the
+// views of third party libraries such as ochttp match naming standards.
+type ViewRule struct {
+	// View selects the views the rule applies to by name.  Use Glob with a
+	// name without wildcards to match a single view.
+	View Matcher
+	// Drop stops the views from being exported.
+	Drop bool
+	// Name, if set, replaces the view name as the name of the metrics.
+	Name string
+	// DropTags are the keys of the tags which are not exported.  Rows
+	// which only differ by these tags are merged.
+	DropTags []string
+	// RenameTags maps the keys of tags to the attribute names they are
+	// exported as.  Rows which have the same tags after renaming are merged.
+	RenameTags map[string]string
+	// Unit, if set, replaces the unit of the measure of the views as the
+	// "measure.unit" attribute.
+	Unit string
+}
+
+// validate returns the problems with the rule.
+func (r *ViewRule) validate() []string {
+	var problems []string
+	if nil == r.View {
+		problems = append(problems, "view rule has no View matcher")
+	}
+	for from, to := range r.RenameTags {
+		if _, err := tag.NewKey(to); nil != err {
+			problems = append(problems, fmt.Sprintf("view rule renames tag %q to invalid key %q", from, to))
+		}
+	}
+	return problems
+}
+
+// viewRule returns the first of the ViewRules which matches the view name.
+func (e *Exporter) viewRule(name string) *ViewRule {
+	for i := range e.ViewRules {
+		r := &e.ViewRules[i]
+		if nil != r.View && r.View.MatchString(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// unitMeasure replaces the unit of a measure.
+type unitMeasure struct {
+	stats.Measure
+	unit string
+}
+
+func (m unitMeasure) Unit() string { return m.unit }
+
+// applyViewRules returns the view data to export after applying the first
+// matching ViewRule to vd, or nil if the view is dropped.  vd is not modified.
+func (e *Exporter) applyViewRules(vd *view.Data) *view.Data {
+	r := e.viewRule(vd.View.Name)
+	if nil == r {
+		return vd
+	}
+	if r.Drop {
+		return nil
+	}
+
+	v := *vd.View
+	if "" != r.Name {
+		v.Name = r.Name
+	}
+	if "" != r.Unit {
+		v.Measure = unitMeasure{Measure: v.Measure, unit: r.Unit}
+	}
+	if 0 == len(r.DropTags) && 0 == len(r.RenameTags) {
+		return &view.Data{View: &v, Start: vd.Start, End: vd.End, Rows: vd.Rows}
+	}
+
+	drop := make(map[string]bool, len(r.DropTags))
+	for _, k := range r.DropTags {
+		drop[k] = true
+	}
+	keys := make(map[string]tag.Key, len(vd.View.TagKeys))
+	v.TagKeys = nil
+	for _, k := range vd.View.TagKeys {
+		if drop[k.Name()] {
+			continue
+		}
+		key := k
+		if to, ok := r.RenameTags[k.Name()]; ok {
+			var err error
+			if key, err = tag.NewKey(to); nil != err {
+				e.handleError(fmt.Errorf("unable to rename tag %q of view %q: %v", k.Name(), vd.View.Name, err))
+				key = k
+			}
+		}
+		keys[k.Name()] = key
+		v.TagKeys = append(v.TagKeys, key)
+	}
+
+	rows := make([]*view.Row, 0, len(vd.Rows))
+	merged := make(map[string]*view.Row, len(vd.Rows))
+	for _, row := range vd.Rows {
+		tags := make([]tag.Tag, 0, len(row.Tags))
+		for _, t := range row.Tags {
+			if drop[t.Key.Name()] {
+				continue
+			}
+			key, ok := keys[t.Key.Name()]
+			if !ok {
+				key = t.Key
+			}
+			tags = append(tags, tag.Tag{Key: key, Value: t.Value})
+		}
+		id := tagSetKey(tags)
+		if existing, ok := merged[id]; ok {
+			existing.Data = mergeAggregationData(existing.Data, row.Data)
+			continue
+		}
+		newRow := &view.Row{Tags: tags, Data: copyAggregationData(row.Data)}
+		merged[id] = newRow
+		rows = append(rows, newRow)
+	}
+	return &view.Data{View: &v, Start: vd.Start, End: vd.End, Rows: rows}
+}